@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ServeEvent records a request BlobloProxy served, whether from cache or
+// via redirect, for the audit trail.
+type ServeEvent struct {
+	Timestamp       time.Time
+	RemoteAddr      string
+	User            string
+	Digest          string
+	Kind            string // "blob" or "manifest"
+	ByteCount       int64
+	UpstreamLatency time.Duration
+	Backend         string
+	Outcome         string // "hit", "redirect", "error"
+}
+
+// UploadEvent records bloblo fetching an object from upstream and writing
+// it into the cache.
+type UploadEvent struct {
+	Timestamp       time.Time
+	RemoteAddr      string
+	User            string
+	Digest          string
+	Kind            string // "blob" or "manifest"
+	ByteCount       int64
+	UpstreamLatency time.Duration
+	Backend         string
+	Outcome         string // "ok", "digest_mismatch", "error"
+}
+
+// AuditSink is a durable record of what bloblo served and cached, distinct
+// from the per-request zap logs - it's meant for compliance trails that
+// outlive log rotation/retention on the proxy host itself.
+type AuditSink interface {
+	RecordServe(evt ServeEvent)
+	RecordUpload(evt UploadEvent)
+}
+
+// noopAuditSink is used when no audit sink is configured.
+type noopAuditSink struct{}
+
+func (noopAuditSink) RecordServe(ServeEvent)   {}
+func (noopAuditSink) RecordUpload(UploadEvent) {}
+
+var _ AuditSink = noopAuditSink{}
+
+func serveEventFields(evt ServeEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"event":               "serve",
+		"timestamp":           evt.Timestamp.UTC().Format(time.RFC3339Nano),
+		"remote_addr":         evt.RemoteAddr,
+		"user":                evt.User,
+		"digest":              evt.Digest,
+		"kind":                evt.Kind,
+		"byte_count":          evt.ByteCount,
+		"upstream_latency_ms": evt.UpstreamLatency.Milliseconds(),
+		"backend":             evt.Backend,
+		"outcome":             evt.Outcome,
+	}
+}
+
+func uploadEventFields(evt UploadEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"event":               "upload",
+		"timestamp":           evt.Timestamp.UTC().Format(time.RFC3339Nano),
+		"remote_addr":         evt.RemoteAddr,
+		"user":                evt.User,
+		"digest":              evt.Digest,
+		"kind":                evt.Kind,
+		"byte_count":          evt.ByteCount,
+		"upstream_latency_ms": evt.UpstreamLatency.Milliseconds(),
+		"backend":             evt.Backend,
+		"outcome":             evt.Outcome,
+	}
+}
+
+// bufferedAuditSink wraps another AuditSink with a buffered channel so a
+// slow or stuck transport (a file system hiccup, a down fluentd) can never
+// stall ServeHTTP. When the buffer is full, events are dropped and counted
+// rather than blocking.
+type bufferedAuditSink struct {
+	sink    AuditSink
+	events  chan auditEvent
+	logger  *zap.Logger
+	dropped uint64
+}
+
+type auditEvent struct {
+	isUpload bool
+	serve    ServeEvent
+	upload   UploadEvent
+}
+
+// defaultAuditBufferSize is how many events bufferedAuditSink queues
+// before it starts dropping.
+const defaultAuditBufferSize = 1024
+
+func newBufferedAuditSink(sink AuditSink, bufferSize int, logger *zap.Logger) *bufferedAuditSink {
+	b := &bufferedAuditSink{
+		sink:   sink,
+		events: make(chan auditEvent, bufferSize),
+		logger: logger,
+	}
+	go b.run()
+	return b
+}
+
+func (b *bufferedAuditSink) run() {
+	for evt := range b.events {
+		if evt.isUpload {
+			b.sink.RecordUpload(evt.upload)
+		} else {
+			b.sink.RecordServe(evt.serve)
+		}
+	}
+}
+
+func (b *bufferedAuditSink) RecordServe(evt ServeEvent) {
+	select {
+	case b.events <- auditEvent{serve: evt}:
+	default:
+		b.logDropped()
+	}
+}
+
+func (b *bufferedAuditSink) RecordUpload(evt UploadEvent) {
+	select {
+	case b.events <- auditEvent{isUpload: true, upload: evt}:
+	default:
+		b.logDropped()
+	}
+}
+
+func (b *bufferedAuditSink) logDropped() {
+	dropped := atomic.AddUint64(&b.dropped, 1)
+	b.logger.Warn("Dropping audit event, buffer full", zap.Uint64("dropped_total", dropped))
+}
+
+var _ AuditSink = (*bufferedAuditSink)(nil)
+
+// rotatingFileWriter is an io.Writer over a file that renames it aside and
+// opens a fresh one once it grows past maxBytes.
+type rotatingFileWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFileWriter(path string, maxBytes int64) (*rotatingFileWriter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &rotatingFileWriter{path: path, maxBytes: maxBytes, file: file, size: info.Size()}, nil
+}
+
+func (w *rotatingFileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxBytes > 0 && w.size+int64(len(p)) > w.maxBytes {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingFileWriter) rotateLocked() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	rotatedPath := fmt.Sprintf("%s.%d", w.path, time.Now().UnixNano())
+	if err := os.Rename(w.path, rotatedPath); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	return nil
+}
+
+// jsonLinesAuditSink writes one JSON object per line to an io.Writer - a
+// plain *os.File for stdout, or a rotatingFileWriter for the file sink.
+type jsonLinesAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newJSONLinesAuditSink(w io.Writer) *jsonLinesAuditSink {
+	return &jsonLinesAuditSink{w: w}
+}
+
+func (s *jsonLinesAuditSink) RecordServe(evt ServeEvent) {
+	s.writeLine(serveEventFields(evt))
+}
+
+func (s *jsonLinesAuditSink) RecordUpload(evt UploadEvent) {
+	s.writeLine(uploadEventFields(evt))
+}
+
+func (s *jsonLinesAuditSink) writeLine(fields map[string]interface{}) {
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(line)
+}
+
+var _ AuditSink = (*jsonLinesAuditSink)(nil)
+
+// syslogFacilityLocal0 is the RFC 5424 facility code conventionally used
+// for application-defined logging.
+const syslogFacilityLocal0 = 16
+
+// rfc5424AuditSink sends one RFC 5424 syslog message per event to a
+// collector over UDP.
+type rfc5424AuditSink struct {
+	conn     net.Conn
+	hostname string
+	appName  string
+	pid      int
+}
+
+func newRFC5424AuditSink(addr string) (*rfc5424AuditSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return &rfc5424AuditSink{conn: conn, hostname: hostname, appName: "bloblo", pid: os.Getpid()}, nil
+}
+
+func (s *rfc5424AuditSink) RecordServe(evt ServeEvent) {
+	s.send("BLOB-SERVE", serveEventFields(evt))
+}
+
+func (s *rfc5424AuditSink) RecordUpload(evt UploadEvent) {
+	s.send("BLOB-UPLOAD", uploadEventFields(evt))
+}
+
+func (s *rfc5424AuditSink) send(msgID string, fields map[string]interface{}) {
+	const severityInformational = 6
+	priority := syslogFacilityLocal0*8 + severityInformational
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		priority,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		s.pid,
+		msgID,
+		formatAuditFields(fields),
+	)
+	s.conn.Write([]byte(msg))
+}
+
+// formatAuditFields renders fields as "key=value" pairs in a stable
+// (sorted) order, so the same event always produces the same message.
+func formatAuditFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+var _ AuditSink = (*rfc5424AuditSink)(nil)
+
+// fluentAuditSink forwards events to a fluentd collector using the forward
+// protocol: MessagePack-encoded ["tag", time, record] entries over a
+// persistent TCP connection. A failed write tears down the connection and
+// redials with exponential backoff rather than retrying in a hot loop.
+type fluentAuditSink struct {
+	addr string
+	tag  string
+
+	mu          sync.Mutex
+	conn        net.Conn
+	backoff     time.Duration
+	nextAttempt time.Time
+
+	logger *zap.Logger
+}
+
+const (
+	fluentMinBackoff = 1 * time.Second
+	fluentMaxBackoff = 30 * time.Second
+)
+
+func newFluentAuditSink(addr, tag string, logger *zap.Logger) *fluentAuditSink {
+	return &fluentAuditSink{addr: addr, tag: tag, logger: logger}
+}
+
+func (f *fluentAuditSink) RecordServe(evt ServeEvent) {
+	f.send(f.tag+".serve", serveEventFields(evt))
+}
+
+func (f *fluentAuditSink) RecordUpload(evt UploadEvent) {
+	f.send(f.tag+".upload", uploadEventFields(evt))
+}
+
+func (f *fluentAuditSink) send(tag string, fields map[string]interface{}) {
+	payload := encodeFluentForwardMessage(tag, time.Now().Unix(), fields)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == nil {
+		if err := f.dialLocked(); err != nil {
+			return
+		}
+	}
+
+	if _, err := f.conn.Write(payload); err != nil {
+		f.logger.Warn("Failed to write audit event to fluentd, reconnecting", zap.String("error", err.Error()))
+		f.conn.Close()
+		f.conn = nil
+		if err := f.dialLocked(); err == nil {
+			f.conn.Write(payload)
+		}
+	}
+}
+
+// dialLocked must be called with f.mu held. It honors the current backoff
+// window, and on failure doubles it (capped at fluentMaxBackoff) so a down
+// fluentd doesn't get hammered with reconnect attempts.
+func (f *fluentAuditSink) dialLocked() error {
+	if time.Now().Before(f.nextAttempt) {
+		return fmt.Errorf("fluent audit sink: still in backoff window")
+	}
+
+	conn, err := net.DialTimeout("tcp", f.addr, 2*time.Second)
+	if err != nil {
+		if f.backoff == 0 {
+			f.backoff = fluentMinBackoff
+		} else {
+			f.backoff *= 2
+			if f.backoff > fluentMaxBackoff {
+				f.backoff = fluentMaxBackoff
+			}
+		}
+		f.nextAttempt = time.Now().Add(f.backoff)
+		f.logger.Warn("Failed to connect to fluentd", zap.String("addr", f.addr), zap.String("error", err.Error()), zap.Duration("retry_in", f.backoff))
+		return err
+	}
+
+	f.conn = conn
+	f.backoff = 0
+	return nil
+}
+
+var _ AuditSink = (*fluentAuditSink)(nil)
+
+// The following are a minimal MessagePack encoder - just enough to encode
+// the ["tag", time, record] triples the fluentd forward protocol expects,
+// without pulling in a full msgpack dependency for three value types.
+
+func encodeFluentForwardMessage(tag string, unixTime int64, record map[string]interface{}) []byte {
+	out := []byte{0x93} // fixarray of length 3
+	out = append(out, msgpackString(tag)...)
+	out = append(out, msgpackInt(unixTime)...)
+	out = append(out, msgpackMap(record)...)
+	return out
+}
+
+func msgpackString(s string) []byte {
+	b := []byte(s)
+	n := len(b)
+
+	var header []byte
+	switch {
+	case n < 32:
+		header = []byte{0xa0 | byte(n)}
+	case n < 1<<8:
+		header = []byte{0xd9, byte(n)}
+	case n < 1<<16:
+		header = []byte{0xda, byte(n >> 8), byte(n)}
+	default:
+		header = []byte{0xdb, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(header, b...)
+}
+
+func msgpackInt(i int64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = 0xd3 // int64
+	binary.BigEndian.PutUint64(buf[1:], uint64(i))
+	return buf
+}
+
+func msgpackFloat(f float64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = 0xcb // float64
+	binary.BigEndian.PutUint64(buf[1:], math.Float64bits(f))
+	return buf
+}
+
+func msgpackBool(b bool) []byte {
+	if b {
+		return []byte{0xc3}
+	}
+	return []byte{0xc2}
+}
+
+func msgpackValue(v interface{}) []byte {
+	switch val := v.(type) {
+	case string:
+		return msgpackString(val)
+	case int:
+		return msgpackInt(int64(val))
+	case int64:
+		return msgpackInt(val)
+	case float64:
+		return msgpackFloat(val)
+	case bool:
+		return msgpackBool(val)
+	default:
+		return msgpackString(fmt.Sprint(val))
+	}
+}
+
+// msgpackMap encodes a map as a MessagePack map, with keys sorted so the
+// wire encoding of a given record is deterministic.
+func msgpackMap(m map[string]interface{}) []byte {
+	n := len(m)
+
+	var header []byte
+	if n < 16 {
+		header = []byte{0x80 | byte(n)}
+	} else {
+		header = []byte{0xde, byte(n >> 8), byte(n)}
+	}
+
+	keys := make([]string, 0, n)
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := header
+	for _, k := range keys {
+		out = append(out, msgpackString(k)...)
+		out = append(out, msgpackValue(m[k])...)
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestJSONLinesAuditSinkWritesOneLinePerEvent(t *testing.T) {
+	var buf bytes.Buffer
+	sink := newJSONLinesAuditSink(&buf)
+
+	sink.RecordServe(ServeEvent{Digest: "sha256:abc", Kind: "blob", Outcome: "hit"})
+	sink.RecordUpload(UploadEvent{Digest: "sha256:def", Kind: "manifest", Outcome: "ok"})
+
+	lines := splitNonEmptyLines(buf.String())
+	assert.Len(t, lines, 2)
+
+	var serveLine map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &serveLine))
+	assert.Equal(t, "serve", serveLine["event"])
+	assert.Equal(t, "sha256:abc", serveLine["digest"])
+
+	var uploadLine map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &uploadLine))
+	assert.Equal(t, "upload", uploadLine["event"])
+	assert.Equal(t, "sha256:def", uploadLine["digest"])
+}
+
+func splitNonEmptyLines(s string) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader([]byte(s)))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestRotatingFileWriterRotatesPastMaxBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	writer, err := newRotatingFileWriter(path, 10)
+	assert.Nil(t, err)
+
+	_, err = writer.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte("more"))
+	assert.Nil(t, err)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2) // the rotated file plus the fresh one
+
+	current, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "more", string(current))
+}
+
+func TestBufferedAuditSinkDropsWhenFull(t *testing.T) {
+	observedZapCore, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(observedZapCore)
+
+	blockUntilReleased := make(chan struct{})
+	started := make(chan struct{}, 1)
+	blocking := &blockingAuditSink{blockUntilReleased: blockUntilReleased, started: started}
+
+	sink := newBufferedAuditSink(blocking, 1, logger)
+
+	// The first event is picked up by run() and blocks it; the buffer
+	// itself (size 1) absorbs the second; the third has nowhere to go.
+	sink.RecordServe(ServeEvent{Digest: "first"})
+	<-started
+	sink.RecordServe(ServeEvent{Digest: "second"})
+	sink.RecordServe(ServeEvent{Digest: "third"})
+
+	close(blockUntilReleased)
+
+	assert.Eventually(t, func() bool {
+		return logs.Len() > 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Contains(t, logs.All()[0].Message, "Dropping audit event")
+}
+
+type blockingAuditSink struct {
+	mu                 sync.Mutex
+	blockUntilReleased chan struct{}
+	started            chan struct{}
+}
+
+func (b *blockingAuditSink) RecordServe(ServeEvent) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.blockUntilReleased
+}
+
+func (b *blockingAuditSink) RecordUpload(UploadEvent) {}
+
+func TestFluentForwardMessageEncodesTagTimeAndRecord(t *testing.T) {
+	encoded := encodeFluentForwardMessage("bloblo.audit.serve", 1700000000, map[string]interface{}{
+		"digest": "sha256:abc",
+	})
+
+	// fixarray(3) + fixstr("bloblo.audit.serve") + int64 + fixmap(1)
+	assert.Equal(t, byte(0x93), encoded[0])
+	assert.Equal(t, byte(0xa0|len("bloblo.audit.serve")), encoded[1])
+	assert.Contains(t, string(encoded), "bloblo.audit.serve")
+	assert.Contains(t, string(encoded), "digest")
+	assert.Contains(t, string(encoded), "sha256:abc")
+}
+
+func TestFluentAuditSinkReconnectsAfterWriteFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	received := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			n, _ := conn.Read(buf)
+			received <- buf[:n]
+			conn.Close()
+		}
+	}()
+
+	observedZapCore, _ := observer.New(zap.WarnLevel)
+	logger := zap.New(observedZapCore)
+
+	sink := newFluentAuditSink(listener.Addr().String(), "bloblo.audit", logger)
+	sink.RecordServe(ServeEvent{Digest: "sha256:first"})
+
+	select {
+	case msg := <-received:
+		assert.Contains(t, string(msg), "sha256:first")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the first fluent message")
+	}
+
+	// Close the connection out from under the sink (as if fluentd
+	// restarted), so the next send's write fails and it has to reconnect
+	// before it can get through.
+	sink.mu.Lock()
+	sink.conn.Close()
+	sink.mu.Unlock()
+
+	sink.RecordServe(ServeEvent{Digest: "sha256:second"})
+
+	select {
+	case msg := <-received:
+		assert.Contains(t, string(msg), "sha256:second")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the reconnected fluent message")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+// AzureObjectStorageCache caches blobs as blobs (fittingly) in an Azure
+// Blob Storage container, for operators running bloblo outside of AWS.
+type AzureObjectStorageCache struct {
+	containerName  string
+	client         *azblob.Client
+	presignExpires time.Duration
+}
+
+func NewAzureObjectStorageCache(client *azblob.Client, containerName string, presignExpires time.Duration) *AzureObjectStorageCache {
+	return &AzureObjectStorageCache{
+		containerName:  containerName,
+		client:         client,
+		presignExpires: presignExpires,
+	}
+}
+
+func (azureCache *AzureObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	blobClient := azureCache.client.ServiceClient().NewContainerClient(azureCache.containerName).NewBlobClient(blobDigest)
+
+	permissions := sas.BlobPermissions{Read: true}
+	return blobClient.GetSASURL(permissions, time.Now().Add(azureCache.presignExpires), nil)
+}
+
+func (azureCache *AzureObjectStorageCache) isBlobInCache(blobDigest string) (bool, error) {
+	blobClient := azureCache.client.ServiceClient().NewContainerClient(azureCache.containerName).NewBlobClient(blobDigest)
+
+	_, err := blobClient.GetProperties(context.TODO(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// uploadBlob ignores tags - Azure Blob Storage has its own index tags
+// feature, but bloblo's bloblo-* tag set is an S3-specific convenience for
+// now, not a cross-backend one.
+func (azureCache *AzureObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	_, err := azureCache.client.UploadStream(context.TODO(), azureCache.containerName, blobDigest, body, &azblob.UploadStreamOptions{
+		Metadata: toAzureMetadata(meta),
+	})
+	return err
+}
+
+func (azureCache *AzureObjectStorageCache) abortBlob(blobDigest string) error {
+	_, err := azureCache.client.DeleteBlob(context.TODO(), azureCache.containerName, blobDigest, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (azureCache *AzureObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	response, err := azureCache.client.DownloadStream(context.TODO(), azureCache.containerName, blobDigest, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return response.Body, fromAzureMetadata(response.Metadata), nil
+}
+
+// Ping confirms the configured container exists and is reachable with the
+// client's credentials.
+func (azureCache *AzureObjectStorageCache) Ping(ctx context.Context) error {
+	_, err := azureCache.client.ServiceClient().NewContainerClient(azureCache.containerName).GetProperties(ctx, nil)
+	return err
+}
+
+func toAzureMetadata(meta map[string]string) map[string]*string {
+	if len(meta) == 0 {
+		return nil
+	}
+	azureMeta := make(map[string]*string, len(meta))
+	for k, v := range meta {
+		v := v
+		azureMeta[k] = &v
+	}
+	return azureMeta
+}
+
+func fromAzureMetadata(meta map[string]*string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	plainMeta := make(map[string]string, len(meta))
+	for k, v := range meta {
+		if v != nil {
+			plainMeta[k] = *v
+		}
+	}
+	return plainMeta
+}
+
+// Make sure AzureObjectStorageCache implements the ObjectStorageCache interface
+var _ ObjectStorageCache = (*AzureObjectStorageCache)(nil)
@@ -1,98 +1,665 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
+// requestIDHeader is the header bloblo reads an existing trace ID from (so
+// it keeps using one minted upstream of it, e.g. by a load balancer) and
+// sets on every request it proxies onward, so operators can grep a single
+// ID across bloblo's own logs and the upstream registry's.
+const requestIDHeader = "X-Request-Id"
+
+// requestID returns req's existing X-Request-Id, minting and attaching a
+// new one if it doesn't have one yet.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	id := uuid.NewString()
+	req.Header.Set(requestIDHeader, id)
+	return id
+}
+
+// localCachePathPrefix is where BlobloProxy serves blobs itself on behalf
+// of cache backends that have no presigned URL of their own (e.g. the
+// filesystem backend).
+const localCachePathPrefix = "/_bloblo_cache/"
+
+// defaultFollowerTimeout bounds how long a request can ride along an
+// in-flight cache-miss fetch for the same digest before giving up and
+// proxying straight to upstream itself.
+const defaultFollowerTimeout = 30 * time.Second
+
+// localBlobServer is implemented by ObjectStorageCache backends that need
+// BlobloProxy to serve their bytes directly rather than redirecting to a
+// presigned URL.
+type localBlobServer interface {
+	ServeBlob(w http.ResponseWriter, req *http.Request, blobDigest string) error
+}
+
 type BlobloProxy struct {
-	upstreamUrl          *url.URL
-	cache                ObjectStorageCache
-	fallbackReverseProxy http.Handler
-	logger               *zap.Logger
-	isCacheableUri       func(requestURI string) bool
+	router atomic.Pointer[UpstreamRouter]
+	// cache is the default ObjectStorageCache, used whenever a route
+	// doesn't name a dedicated one of its own, and always used to serve
+	// the /_bloblo_cache/ local-blob path regardless of route - a route's
+	// dedicated cache is only reachable through a presigned URL.
+	cache  ObjectStorageCache
+	logger *zap.Logger
+	policy CacheabilityPolicy
+	audit  AuditSink
+
+	// missFetches coalesces concurrent upstream fetches for the same
+	// digest so N simultaneous cache misses result in a single upstream
+	// GET and a single cache upload.
+	missFetches singleflight.Group
+	followerTimeout time.Duration
+}
+
+func NewBlobloProxy(router *UpstreamRouter, cache ObjectStorageCache, logger *zap.Logger) *BlobloProxy {
+	blo := &BlobloProxy{
+		cache:           cache,
+		logger:          logger,
+		followerTimeout: defaultFollowerTimeout,
+		policy:          defaultCacheabilityPolicy{},
+		audit:           noopAuditSink{},
+	}
+	blo.router.Store(router)
+	return blo
+}
+
+// CurrentRouter returns the UpstreamRouter blo is dispatching requests
+// through right now.
+func (blo *BlobloProxy) CurrentRouter() *UpstreamRouter {
+	return blo.router.Load()
+}
+
+// SetRouter atomically swaps the router blo dispatches through. Requests
+// already in flight keep using whichever route they resolved; everything
+// after the swap resolves against the new router.
+func (blo *BlobloProxy) SetRouter(router *UpstreamRouter) {
+	blo.router.Store(router)
+}
+
+// cacheBackendName identifies the active ObjectStorageCache implementation
+// for the audit trail, without needing to widen the interface just for a
+// label. A DynamicObjectStorageCache is unwrapped first, so a config
+// reload that swaps backends is reflected immediately.
+func cacheBackendName(cache ObjectStorageCache) string {
+	if dynamic, ok := cache.(*DynamicObjectStorageCache); ok {
+		cache = dynamic.Backend()
+	}
+
+	name := fmt.Sprintf("%T", cache)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		return name[idx+1:]
+	}
+	return name
 }
 
-func NewBlobloProxy(upstreamUrl *url.URL, cache ObjectStorageCache, fallbackReverseProxy http.Handler, logger *zap.Logger) *BlobloProxy {
-	return &BlobloProxy{
-		upstreamUrl:          upstreamUrl,
-		cache:                cache,
-		fallbackReverseProxy: fallbackReverseProxy,
-		logger:               logger,
+// blobTags builds the bloblo-* tag set recorded against a newly cached
+// object, for backends (s3) that can attach it as real object tags so
+// operators can drive bucket lifecycle rules, cost-allocation reports and
+// replication policies off of them.
+func blobTags(route UpstreamRoute, req *http.Request, digest string) map[string]string {
+	tags := map[string]string{
+		"bloblo-upstream":  route.UpstreamURL.Host,
+		"bloblo-cached-at": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if regPath, ok := parseRegistryPath(req.RequestURI); ok {
+		if repo := repositoryFor(regPath); repo != "" {
+			tags["bloblo-repo"] = repo
+		}
+	}
 
-		isCacheableUri: func(requestURI string) bool {
-			pathElements := strings.Split(requestURI, "/")
-			return len(pathElements) > 2 && pathElements[len(pathElements)-2] == "blobs"
-		},
+	if algo, _, err := splitDigest(digest); err == nil {
+		tags["bloblo-digest-algo"] = algo
 	}
+
+	return tags
 }
 
-func (blo *BlobloProxy) getUpstreamRequest(req *http.Request) *http.Request {
+// metricLabels derives the repo/algo labels bloblo's per-request metrics
+// are broken down by from req and digest, falling back to "unknown" when
+// there isn't enough information to fill one in - e.g. a manifest request
+// still addressed by tag has no digest to derive algo from yet.
+func metricLabels(req *http.Request, digest string) (repo, algo string) {
+	repo, algo = "unknown", "unknown"
+
+	// req.URL.Path rather than req.RequestURI: doUpstreamRequest is also
+	// called with the upstream-bound clone getUpstreamRequest produces,
+	// which has RequestURI blanked out (http.Client rejects a non-empty
+	// one) but keeps URL.Path intact.
+	if regPath, ok := parseRegistryPath(req.URL.Path); ok {
+		if r := repositoryFor(regPath); r != "" {
+			repo = r
+		}
+	}
+	if a, _, err := splitDigest(digest); err == nil {
+		algo = a
+	}
+
+	return repo, algo
+}
+
+// doUpstreamRequest performs req against the upstream registry, recording
+// its latency under bloblo_upstream_request_duration_seconds.
+func doUpstreamRequest(req *http.Request) (*http.Response, error) {
+	repo, algo := metricLabels(req, "")
+	start := time.Now()
+	response, err := http.DefaultClient.Do(req)
+	upstreamRequestDuration.WithLabelValues(req.Method, repo, algo).Observe(time.Since(start).Seconds())
+	return response, err
+}
+
+func (blo *BlobloProxy) getUpstreamRequest(req *http.Request, route UpstreamRoute) *http.Request {
 	upstreamReq := req.Clone(req.Context())
 	upstreamReq.RequestURI = ""
-	upstreamReq.Host = blo.upstreamUrl.Host
-	upstreamReq.URL.Host = blo.upstreamUrl.Host
-	upstreamReq.URL.Scheme = blo.upstreamUrl.Scheme
+	upstreamReq.Host = route.UpstreamURL.Host
+	upstreamReq.URL.Host = route.UpstreamURL.Host
+	upstreamReq.URL.Scheme = route.UpstreamURL.Scheme
+	upstreamReq.Header.Set(requestIDHeader, requestID(req))
 	return upstreamReq
 }
 
+// countingResponseWriter tracks how many bytes have been written through
+// it, so proxyToUpstream can report how many bytes a fallback response
+// proxied to the client without changing what it streams. It forwards
+// Flush so streamed (chunked, long-running) upstream responses proxied via
+// httputil.ReverseProxy still flush incrementally instead of buffering.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// proxyToUpstream proxies req to route's upstream directly instead of
+// serving it from the cache, recording why (reason) under
+// bloblo_upstream_fallback_total and how many bytes were streamed through
+// under bloblo_bytes_transferred_total. digest may be "" when the request
+// never resolved to one (e.g. it isn't registry-shaped at all).
+func (blo *BlobloProxy) proxyToUpstream(w http.ResponseWriter, req *http.Request, route UpstreamRoute, kind, digest, reason string) {
+	repo, algo := metricLabels(req, digest)
+	upstreamFallbackTotal.WithLabelValues(repo, algo, reason).Inc()
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	route.reverseProxy.ServeHTTP(counter, req)
+	bytesTransferredTotal.WithLabelValues(kind, repo, algo, "upstream").Add(float64(counter.n))
+}
+
+// presignURL generates a presigned URL for cacheKey, recording its latency
+// under bloblo_presign_duration_seconds and its outcome under
+// bloblo_presign_requests_total.
+func presignURL(cache ObjectStorageCache, req *http.Request, cacheKey, digest string) (string, error) {
+	repo, algo := metricLabels(req, digest)
+
+	start := time.Now()
+	url, err := cache.getPresignedUrl(cacheKey)
+	presignDuration.WithLabelValues(repo, algo).Observe(time.Since(start).Seconds())
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	presignRequestsTotal.WithLabelValues(repo, algo, outcome).Inc()
+
+	return url, err
+}
+
 func (blo *BlobloProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	blo.logger.Info("Incoming request", zap.String("request", req.RequestURI), zap.String("method", req.Method))
-
-	if req.Method == http.MethodGet && blo.isCacheableUri(req.RequestURI) {
-		pathElements := strings.Split(req.RequestURI, "/")
-		blobDigest := pathElements[len(pathElements)-1]
-
-		headReq := blo.getUpstreamRequest(req)
-		headReq.Method = http.MethodHead
-		response, err := http.DefaultClient.Do(headReq)
-		if err != nil {
-			blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
+	reqID := requestID(req)
+	blo.logger.Info("Incoming request", zap.String("request", req.RequestURI), zap.String("method", req.Method), zap.String("request_id", reqID))
+
+	if strings.HasPrefix(req.URL.Path, localCachePathPrefix) && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		blo.serveLocalBlob(w, req)
+		return
+	}
+
+	router := blo.CurrentRouter()
+
+	regPath, ok := parseRegistryPath(req.RequestURI)
+	if !ok {
+		blo.proxyToUpstream(w, req, router.Default(), "", "", "not_registry_shaped")
+		return
+	}
+
+	route := router.Match(regPath)
+	decision := blo.policy.Evaluate(req, regPath)
+
+	if decision.Action == PolicyActionDeny {
+		blo.logger.Info("Denying request per cacheability policy", zap.String("request", req.RequestURI), zap.String("action", "policy_deny"), zap.String("request_id", reqID))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if decision.Action != PolicyActionCache || req.Method != http.MethodGet {
+		blo.proxyToUpstream(w, req, route, regPath.Kind, regPath.Reference, "policy_bypass")
+		return
+	}
+
+	if regPath.Kind == "manifests" {
+		blo.handleManifestRequest(w, req, route, regPath.Reference)
+		return
+	}
+
+	blobDigest := regPath.Reference
+	cache := route.cacheFor(blo.cache)
+	cacheKey := route.cacheKey(blobDigest)
+
+	headReq := blo.getUpstreamRequest(req, route)
+	headReq.Method = http.MethodHead
+	response, err := doUpstreamRequest(headReq)
+	if err != nil {
+		blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()), zap.String("request_id", reqID))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "upstream_miss")
+		return
+	}
+
+	isInCache, err := cache.isBlobInCache(cacheKey)
+	if err != nil {
+		blo.logger.Error("Failed to check if object is in cache", zap.String("error", err.Error()), zap.String("request_id", reqID))
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "cache_check_error")
+		return
+	}
+
+	if !isInCache { // upload the blob to cache and return the layer to the client
+		blo.handleCacheMiss(w, req, route, blobDigest)
+		return
+	}
+
+	user, _, _ := headReq.BasicAuth()
+	blo.logger.Info("Serving blob from cache", zap.String("digest", blobDigest), zap.String("user", user), zap.String("action", "serve_blob"), zap.String("request_id", reqID))
+	presignedUrl, err := presignURL(cache, req, cacheKey, blobDigest)
+	if err != nil {
+		blo.logger.Error("Failed to get a presign url", zap.String("digest", blobDigest), zap.String("error", err.Error()), zap.String("request_id", reqID))
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "presign_error")
+		return
+	}
+
+	repo, algo := metricLabels(req, blobDigest)
+	cacheHitsTotal.WithLabelValues("blob", repo, algo).Inc()
+	blo.audit.RecordServe(ServeEvent{
+		Timestamp:  time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		User:       user,
+		Digest:     blobDigest,
+		Kind:       "blob",
+		Backend:    cacheBackendName(cache),
+		Outcome:    "hit",
+	})
+
+	http.Redirect(w, req, presignedUrl, http.StatusFound)
+}
+
+// handleCacheMiss coalesces concurrent misses for the same digest: the
+// request whose call singleflight actually dispatches (the executor)
+// fetches from upstream and tees the body to both the cache and its own
+// response, while concurrent requests for the same digest (followers) wait
+// for that fetch to finish and then redirect to the presigned URL it
+// produced. A follower that waits longer than followerTimeout gives up and
+// proxies straight to upstream instead.
+//
+// isExecutor is flipped from inside the closure itself, rather than
+// tracked in a separate map keyed by cacheKey: singleflight.DoChan picks
+// which caller's closure actually runs independently of any bookkeeping we
+// do before calling it, so a separate map can disagree with singleflight
+// about who's really fetching - and whichever call ends up wrongly
+// thinking it's a follower would proxy to upstream on the very same
+// ResponseWriter its own (mis-identified-as-someone-else's) fetch is still
+// streaming into.
+func (blo *BlobloProxy) handleCacheMiss(w http.ResponseWriter, req *http.Request, route UpstreamRoute, blobDigest string) {
+	repo, algo := metricLabels(req, blobDigest)
+	cacheMissesTotal.WithLabelValues("blob", repo, algo).Inc()
+
+	cacheKey := route.cacheKey(blobDigest)
+
+	var isExecutor atomic.Bool
+	resultChan := blo.missFetches.DoChan(cacheKey, func() (interface{}, error) {
+		isExecutor.Store(true)
+		return nil, blo.fetchAndCacheBlob(w, req, route, blobDigest)
+	})
+
+	select {
+	case result := <-resultChan:
+		blo.finishCacheMiss(w, req, route, blobDigest, isExecutor.Load(), result.Err)
+	case <-time.After(blo.followerTimeout):
+		if isExecutor.Load() {
+			// Our own fetch is the one streaming into w - abandoning it
+			// now and writing to w ourselves would race with it, so wait
+			// however long it takes instead of falling back to upstream.
+			result := <-resultChan
+			blo.finishCacheMiss(w, req, route, blobDigest, true, result.Err)
 			return
 		}
-		defer response.Body.Close()
-		if response.StatusCode == http.StatusOK {
-			isInCache, err := blo.cache.isBlobInCache(blobDigest)
-			if err != nil {
-				blo.logger.Error("Failed to check if object is in cache", zap.String("error", err.Error()))
-			} else if isInCache {
-				user, _, _ := headReq.BasicAuth()
-				blo.logger.Info("Serving blob from cache", zap.String("digest", blobDigest), zap.String("user", user), zap.String("action", "serve_blob"))
-				presignedUrl, err := blo.cache.getPresignedUrl(blobDigest)
-				if err != nil {
-					blo.logger.Error("Failed to get a presign url", zap.String("digest", blobDigest), zap.String("error", err.Error()))
-					blo.fallbackReverseProxy.ServeHTTP(w, req)
-					return
-				}
-
-				http.Redirect(w, req, presignedUrl, http.StatusFound)
-				return
-			} else { // upload the blob to cache and return the layer to the client
-				upstreamReq := blo.getUpstreamRequest(req)
-				response, err := http.DefaultClient.Do(upstreamReq)
-				if err != nil {
-					blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()))
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				defer response.Body.Close()
-				teeReader := io.TeeReader(response.Body, w)
-
-				blo.logger.Info("Uploading blob to cache", zap.String("digest", blobDigest), zap.String("action", "upload_blob"))
-				err = blo.cache.uploadBlob(blobDigest, teeReader)
-				if err != nil {
-					blo.logger.Error("Error uploading blob", zap.String("digest", blobDigest), zap.String("error", err.Error()))
-				}
-
-				return
-			}
+		singleflightDedupedTotal.Inc()
+		blo.logger.Warn("Timed out waiting for an in-flight cache fetch, falling back to upstream", zap.String("digest", blobDigest), zap.String("request_id", requestID(req)))
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "follower_timeout")
+	}
+}
+
+// finishCacheMiss handles a coalesced fetch's result once it's available.
+// The executor's own fetchAndCacheBlob has already streamed the response
+// into w itself, so there's nothing left to do but log a failure; a
+// follower still needs to redirect its own client to the presigned URL the
+// fetch produced.
+func (blo *BlobloProxy) finishCacheMiss(w http.ResponseWriter, req *http.Request, route UpstreamRoute, blobDigest string, isExecutor bool, fetchErr error) {
+	if isExecutor {
+		if fetchErr != nil {
+			blo.logger.Error("Error uploading blob", zap.String("digest", blobDigest), zap.String("error", fetchErr.Error()))
 		}
+		return
+	}
+
+	singleflightDedupedTotal.Inc()
+	blo.serveFollowerFromCache(w, req, route, blobDigest, fetchErr)
+}
+
+// fetchAndCacheBlob fetches blobDigest from upstream, streaming it to w
+// while simultaneously verifying its digest and uploading it to the cache.
+func (blo *BlobloProxy) fetchAndCacheBlob(w http.ResponseWriter, req *http.Request, route UpstreamRoute, blobDigest string) error {
+	start := time.Now()
+	cache := route.cacheFor(blo.cache)
+	cacheKey := route.cacheKey(blobDigest)
+
+	upstreamReq := blo.getUpstreamRequest(req, route)
+	response, err := doUpstreamRequest(upstreamReq)
+	if err != nil {
+		blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	defer response.Body.Close()
+
+	user, _, _ := upstreamReq.BasicAuth()
+	repo, algo := metricLabels(req, blobDigest)
+	counter := &countingWriter{w: w}
+
+	hasher, hexDigest, digestErr := newDigestHasher(blobDigest)
+	if digestErr != nil {
+		// Nothing we recognize to verify against - stream straight
+		// through without caching.
+		blo.logger.Error("Cannot verify blob digest", zap.String("digest", blobDigest), zap.String("error", digestErr.Error()))
+		io.Copy(counter, response.Body)
+		bytesTransferredTotal.WithLabelValues("blob", repo, algo, "upstream").Add(float64(counter.n))
+		return nil
+	}
+	teeReader := io.TeeReader(io.TeeReader(response.Body, hasher), counter)
+
+	blo.logger.Info("Uploading blob to cache", zap.String("digest", blobDigest), zap.String("action", "upload_blob"))
+	uploadStart := time.Now()
+	uploadErr := cache.uploadBlob(cacheKey, teeReader, nil, blobTags(route, req, blobDigest))
+	cacheUploadDuration.WithLabelValues("blob").Observe(time.Since(uploadStart).Seconds())
+	cacheUploadBytesTotal.WithLabelValues("blob").Add(float64(counter.n))
+	bytesTransferredTotal.WithLabelValues("blob", repo, algo, "upstream").Add(float64(counter.n))
+
+	outcome := "ok"
+	if uploadErr != nil {
+		outcome = "error"
+	}
+
+	if !verifyDigest(hasher, hexDigest) {
+		digestMismatchesTotal.Inc()
+		blo.logger.Warn("Upstream blob did not match its digest", zap.String("digest", blobDigest), zap.String("action", "digest_mismatch"))
+		if abortErr := cache.abortBlob(cacheKey); abortErr != nil {
+			blo.logger.Error("Failed to abort corrupt cache upload", zap.String("digest", blobDigest), zap.String("error", abortErr.Error()))
+		}
+		blo.audit.RecordUpload(UploadEvent{
+			Timestamp:       start,
+			RemoteAddr:      req.RemoteAddr,
+			User:            user,
+			Digest:          blobDigest,
+			Kind:            "blob",
+			ByteCount:       counter.n,
+			UpstreamLatency: time.Since(start),
+			Backend:         cacheBackendName(cache),
+			Outcome:         "digest_mismatch",
+		})
+		return fmt.Errorf("digest mismatch for %s", blobDigest)
+	}
+
+	blo.audit.RecordUpload(UploadEvent{
+		Timestamp:       start,
+		RemoteAddr:      req.RemoteAddr,
+		User:            user,
+		Digest:          blobDigest,
+		Kind:            "blob",
+		ByteCount:       counter.n,
+		UpstreamLatency: time.Since(start),
+		Backend:         cacheBackendName(cache),
+		Outcome:         outcome,
+	})
+
+	return uploadErr
+}
+
+// countingWriter tracks how many bytes have been written through it, so
+// fetchAndCacheBlob can report a byte count to the audit sink without
+// changing what it streams to the client.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// serveFollowerFromCache redirects a follower request to the blob that the
+// leader request (hopefully) just finished caching.
+func (blo *BlobloProxy) serveFollowerFromCache(w http.ResponseWriter, req *http.Request, route UpstreamRoute, blobDigest string, leaderErr error) {
+	if leaderErr != nil {
+		blo.logger.Warn("In-flight cache fetch failed, falling back to upstream", zap.String("digest", blobDigest), zap.String("error", leaderErr.Error()), zap.String("request_id", requestID(req)))
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "follower_leader_error")
+		return
+	}
+
+	presignedUrl, err := presignURL(route.cacheFor(blo.cache), req, route.cacheKey(blobDigest), blobDigest)
+	if err != nil {
+		blo.logger.Error("Failed to get a presign url", zap.String("digest", blobDigest), zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		blo.proxyToUpstream(w, req, route, "blob", blobDigest, "presign_error")
+		return
+	}
+
+	http.Redirect(w, req, presignedUrl, http.StatusFound)
+}
+
+// manifestDigestHeader is the Docker Registry v2 response header carrying
+// the canonical digest of a manifest - used to resolve the cache key when
+// the request addressed the manifest by tag rather than by digest.
+const manifestDigestHeader = "Docker-Content-Digest"
+
+// handleManifestRequest caches OCI/Docker manifests, which unlike blobs may
+// be addressed by tag rather than digest and are small enough to serve
+// inline from the cache instead of via a presigned redirect.
+func (blo *BlobloProxy) handleManifestRequest(w http.ResponseWriter, req *http.Request, route UpstreamRoute, reference string) {
+	headReq := blo.getUpstreamRequest(req, route)
+	headReq.Method = http.MethodHead
+	response, err := doUpstreamRequest(headReq)
+	if err != nil {
+		blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		blo.proxyToUpstream(w, req, route, "manifest", reference, "upstream_miss")
+		return
+	}
+
+	digest := reference
+	if _, _, err := splitDigest(reference); err != nil {
+		digest = response.Header.Get(manifestDigestHeader)
+	}
+	if digest == "" {
+		// We have no content-addressed key to cache under - just proxy.
+		blo.proxyToUpstream(w, req, route, "manifest", reference, "no_digest")
+		return
+	}
+
+	cache := route.cacheFor(blo.cache)
+	cacheKey := route.cacheKey(digest)
+
+	isInCache, err := cache.isBlobInCache(cacheKey)
+	if err != nil {
+		blo.logger.Error("Failed to check if manifest is in cache", zap.String("digest", digest), zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		blo.proxyToUpstream(w, req, route, "manifest", digest, "cache_check_error")
+		return
+	}
+
+	if isInCache {
+		blo.serveManifestFromCache(w, req, route, digest)
+		return
+	}
+
+	blo.fetchAndCacheManifest(w, req, route, digest)
+}
+
+func (blo *BlobloProxy) serveManifestFromCache(w http.ResponseWriter, req *http.Request, route UpstreamRoute, digest string) {
+	cache := route.cacheFor(blo.cache)
+	body, meta, err := cache.getBlob(route.cacheKey(digest))
+	if err != nil {
+		blo.logger.Error("Failed to read cached manifest", zap.String("digest", digest), zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	repo, algo := metricLabels(req, digest)
+	cacheHitsTotal.WithLabelValues("manifest", repo, algo).Inc()
+	blo.logger.Info("Serving manifest from cache", zap.String("digest", digest), zap.String("action", "serve_manifest"), zap.String("request_id", requestID(req)))
+	w.Header().Set(manifestDigestHeader, digest)
+	if contentType := meta["Content-Type"]; contentType != "" {
+		w.Header().Set("Content-Type", contentType)
 	}
+	counter := &countingWriter{w: w}
+	io.Copy(counter, body)
+	bytesTransferredTotal.WithLabelValues("manifest", repo, algo, "cache").Add(float64(counter.n))
 
-	blo.fallbackReverseProxy.ServeHTTP(w, req)
+	user, _, _ := req.BasicAuth()
+	blo.audit.RecordServe(ServeEvent{
+		Timestamp:  time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		User:       user,
+		Digest:     digest,
+		Kind:       "manifest",
+		ByteCount:  counter.n,
+		Backend:    cacheBackendName(cache),
+		Outcome:    "hit",
+	})
+}
+
+func (blo *BlobloProxy) fetchAndCacheManifest(w http.ResponseWriter, req *http.Request, route UpstreamRoute, digest string) {
+	repo, algo := metricLabels(req, digest)
+	cacheMissesTotal.WithLabelValues("manifest", repo, algo).Inc()
+	start := time.Now()
+	cache := route.cacheFor(blo.cache)
+
+	upstreamReq := blo.getUpstreamRequest(req, route)
+	response, err := doUpstreamRequest(upstreamReq)
+	if err != nil {
+		blo.logger.Error("Failed to reach the upstream", zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		blo.logger.Error("Failed to read manifest body", zap.String("digest", digest), zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	meta := map[string]string{"Content-Type": contentType}
+
+	blo.logger.Info("Uploading manifest to cache", zap.String("digest", digest), zap.String("action", "upload_manifest"))
+	uploadStart := time.Now()
+	uploadErr := cache.uploadBlob(route.cacheKey(digest), bytes.NewReader(body), meta, blobTags(route, req, digest))
+	cacheUploadDuration.WithLabelValues("manifest").Observe(time.Since(uploadStart).Seconds())
+	cacheUploadBytesTotal.WithLabelValues("manifest").Add(float64(len(body)))
+	bytesTransferredTotal.WithLabelValues("manifest", repo, algo, "upstream").Add(float64(len(body)))
+	if uploadErr != nil {
+		blo.logger.Error("Error uploading manifest", zap.String("digest", digest), zap.String("error", uploadErr.Error()))
+	}
+
+	outcome := "ok"
+	if uploadErr != nil {
+		outcome = "error"
+	}
+	user, _, _ := upstreamReq.BasicAuth()
+	blo.audit.RecordUpload(UploadEvent{
+		Timestamp:       start,
+		RemoteAddr:      req.RemoteAddr,
+		User:            user,
+		Digest:          digest,
+		Kind:            "manifest",
+		ByteCount:       int64(len(body)),
+		UpstreamLatency: time.Since(start),
+		Backend:         cacheBackendName(cache),
+		Outcome:         outcome,
+	})
+
+	w.Header().Set(manifestDigestHeader, digest)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Write(body)
+}
+
+// serveLocalBlob always serves out of blo.cache, the default backend - it
+// has no route to resolve a dedicated cache against, since the client's
+// request here is a fresh, routeless GET against the presigned-ish URL
+// getPresignedUrl handed out earlier. A route with a dedicated Cache only
+// works as expected if that cache hands out real presigned URLs (s3, gcs,
+// azure); pairing a dedicated route cache with the filesystem backend is
+// unsupported.
+func (blo *BlobloProxy) serveLocalBlob(w http.ResponseWriter, req *http.Request) {
+	server, ok := blo.cache.(localBlobServer)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	blobDigest := strings.TrimPrefix(req.URL.Path, localCachePathPrefix)
+	repo, algo := metricLabels(req, blobDigest)
+	counter := &countingResponseWriter{ResponseWriter: w}
+	if err := server.ServeBlob(counter, req, blobDigest); err != nil {
+		blo.logger.Error("Failed to serve cached blob", zap.String("digest", blobDigest), zap.String("error", err.Error()), zap.String("request_id", requestID(req)))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bytesTransferredTotal.WithLabelValues("blob", repo, algo, "cache").Add(float64(counter.n))
 }
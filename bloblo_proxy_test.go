@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"net/http/httputil"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,27 +19,74 @@ import (
 )
 
 type testObjectStorageCache struct {
+	mu sync.Mutex
+
 	checkedForBlob           bool
 	uploadedBlob             bool
 	redirectedToPresignedUrl bool
+	abortedBlob              bool
+	uploadCount              int
+	uploadedBody             []byte
+	uploadedMeta             map[string]string
+	uploadedTags             map[string]string
 
 	defaultPresignedUrl string
 }
 
 func (cache *testObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 	cache.redirectedToPresignedUrl = true
 	return cache.defaultPresignedUrl, nil
 }
 
 func (cache *testObjectStorageCache) isBlobInCache(blobDigest string) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 	cache.checkedForBlob = true
 
 	return cache.uploadedBlob, nil
 }
 
-func (cache *testObjectStorageCache) uploadBlob(blobDigest string, body io.Reader) error {
+func (cache *testObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	uploaded, _ := io.ReadAll(body)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 	cache.uploadedBlob = true
-	io.ReadAll(body)
+	cache.uploadCount++
+	cache.uploadedBody = uploaded
+	cache.uploadedMeta = meta
+	cache.uploadedTags = tags
+	return nil
+}
+
+func (cache *testObjectStorageCache) abortBlob(blobDigest string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.abortedBlob = true
+	return nil
+}
+
+func (cache *testObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(cache.uploadedBody)), cache.uploadedMeta, nil
+}
+
+func (cache *testObjectStorageCache) getUploadCount() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.uploadCount
+}
+
+func (cache *testObjectStorageCache) getUploadedTags() map[string]string {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.uploadedTags
+}
+
+func (cache *testObjectStorageCache) Ping(ctx context.Context) error {
 	return nil
 }
 
@@ -49,7 +98,15 @@ type testBackend struct {
 }
 
 func newTestBackend(defaultResponse string) (*testBackend, error) {
+	return newTestBackendWithDelay(defaultResponse, 0)
+}
+
+// newTestBackendWithDelay sleeps before responding to every request, which
+// widens the window during which concurrent BlobloProxy requests overlap -
+// useful for exercising singleflight coalescing.
+func newTestBackendWithDelay(defaultResponse string, delay time.Duration) (*testBackend, error) {
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
 		fmt.Fprint(w, defaultResponse)
 	}))
 	backendUrl, err := url.Parse(fmt.Sprint("http://", testServer.Listener.Addr().String()))
@@ -64,6 +121,13 @@ func newTestBackend(defaultResponse string) (*testBackend, error) {
 	}, err
 }
 
+// newTestSingleUpstreamRouter builds the single-upstream UpstreamRouter
+// equivalent to what bloblo ran before multi-upstream routing existed,
+// for tests that don't care about routing itself.
+func newTestSingleUpstreamRouter(upstreamUrl *url.URL, logger *zap.Logger) *UpstreamRouter {
+	return NewUpstreamRouter(nil, UpstreamRoute{UpstreamURL: upstreamUrl}, logger)
+}
+
 type testFixture struct {
 	cache         *testObjectStorageCache
 	tBlobloServer *httptest.Server
@@ -72,6 +136,10 @@ type testFixture struct {
 }
 
 func newTestFixture(t *testing.T) *testFixture {
+	return newTestFixtureWithBackendDelay(t, 0)
+}
+
+func newTestFixtureWithBackendDelay(t *testing.T, backendDelay time.Duration) *testFixture {
 	observedZapCore, _ := observer.New(zap.InfoLevel)
 	logger := zap.New(observedZapCore)
 
@@ -79,11 +147,11 @@ func newTestFixture(t *testing.T) *testFixture {
 		defaultPresignedUrl: "http://localtest.me/a_presigned_url",
 	}
 
-	backendTestServer, err := newTestBackend("test response")
+	backendTestServer, err := newTestBackendWithDelay("test response", backendDelay)
 	assert.Nil(t, err)
 
-	fallbackReverseProxy := httputil.NewSingleHostReverseProxy(backendTestServer.url)
-	blo := NewBlobloProxy(backendTestServer.url, cache, fallbackReverseProxy, logger)
+	router := newTestSingleUpstreamRouter(backendTestServer.url, logger)
+	blo := NewBlobloProxy(router, cache, logger)
 
 	return &testFixture{
 		cache:         cache,
@@ -93,6 +161,106 @@ func newTestFixture(t *testing.T) *testFixture {
 	}
 }
 
+// newTestFixtureWithFilesystemCache builds the same fixture as
+// newTestFixture, but backed by a real FilesystemObjectStorageCache wrapped
+// in a DynamicObjectStorageCache - exactly how main wires up the fs backend
+// - instead of the fake testObjectStorageCache. It exists so the caching
+// behavior suite also runs against the real fs backend through the dynamic
+// wrapper, not just the fake, since that's the combination serveLocalBlob
+// actually has to work against in production.
+func newTestFixtureWithFilesystemCache(t *testing.T) *testFixture {
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	fsCache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+	dynamicCache := NewDynamicObjectStorageCache(fsCache)
+
+	backendTestServer, err := newTestBackend("test response")
+	assert.Nil(t, err)
+
+	router := newTestSingleUpstreamRouter(backendTestServer.url, logger)
+	blo := NewBlobloProxy(router, dynamicCache, logger)
+
+	return &testFixture{
+		tBlobloServer: httptest.NewServer(blo),
+		tBloblo:       blo,
+		tBackend:      backendTestServer,
+	}
+}
+
+func TestBlobIsUploadedToFilesystemCacheAndReturnedToClient(t *testing.T) {
+	fixture := newTestFixtureWithFilesystemCache(t)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	client := http.Client{Timeout: 1 * time.Second}
+	// The sha256 of the test backend's "test response" body, so the blob
+	// passes digest verification and stays in the fs cache.
+	cacheablePath := "/v2/blobs/sha256:3ed59d9f6e32da0f3c9784f5f1f178565b7627537b7be4314d2fcfe2d284f912"
+	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, fixture.tBackend.defaultResponse, string(body))
+}
+
+// TestClientIsServedFromFilesystemCacheWhenBlobInCache proves the fs
+// backend's whole round trip - wrapped in a DynamicObjectStorageCache, same
+// as main always wraps it - actually works end to end: a second request for
+// the same blob is redirected to /_bloblo_cache/ and served locally, rather
+// than 404ing because serveLocalBlob's localBlobServer type assertion
+// failed against the dynamic wrapper.
+func TestClientIsServedFromFilesystemCacheWhenBlobInCache(t *testing.T) {
+	fixture := newTestFixtureWithFilesystemCache(t)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	client := http.Client{Timeout: 1 * time.Second}
+	// The sha256 of the test backend's "test response" body, so the first
+	// request's upload passes digest verification and stays cached.
+	cacheablePath := "/v2/blobs/sha256:3ed59d9f6e32da0f3c9784f5f1f178565b7627537b7be4314d2fcfe2d284f912"
+	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	resp, err = client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fixture.tBackend.defaultResponse, string(body))
+}
+
+func TestSetRouterSwapsTheUpstreamBlobloProxyRequests(t *testing.T) {
+	fixture := newTestFixture(t)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	otherBackend, err := newTestBackend("other backend response")
+	assert.Nil(t, err)
+	defer otherBackend.server.Close()
+
+	assert.Equal(t, fixture.tBackend.url, fixture.tBloblo.CurrentRouter().Default().UpstreamURL)
+
+	fixture.tBloblo.SetRouter(newTestSingleUpstreamRouter(otherBackend.url, fixture.tBloblo.logger))
+	assert.Equal(t, otherBackend.url, fixture.tBloblo.CurrentRouter().Default().UpstreamURL)
+
+	client := http.Client{Timeout: 1 * time.Second}
+	cacheablePath := "/v2/blobs/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, otherBackend.defaultResponse, string(body))
+}
+
 func TestFallbackForNotCacheablePath(t *testing.T) {
 	fixture := newTestFixture(t)
 	defer fixture.tBlobloServer.Close()
@@ -144,6 +312,62 @@ func TestBlobIsUploadedToCacheAndReturnedToClient(t *testing.T) {
 	assert.False(t, fixture.cache.redirectedToPresignedUrl)
 }
 
+func TestBlobIsUploadedWithBlobloTags(t *testing.T) {
+	fixture := newTestFixture(t)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	client := http.Client{Timeout: 1 * time.Second}
+	cacheablePath := "/v2/myorg/myrepo/blobs/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	tags := fixture.cache.getUploadedTags()
+	assert.Equal(t, fixture.tBackend.url.Host, tags["bloblo-upstream"])
+	assert.Equal(t, "myorg/myrepo", tags["bloblo-repo"])
+	assert.Equal(t, "sha256", tags["bloblo-digest-algo"])
+	assert.NotEmpty(t, tags["bloblo-cached-at"])
+}
+
+func TestRequestIdIsPropagatedToUpstream(t *testing.T) {
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	var mu sync.Mutex
+	var capturedRequestIds []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		capturedRequestIds = append(capturedRequestIds, r.Header.Get("X-Request-Id"))
+		mu.Unlock()
+		fmt.Fprint(w, "test response")
+	}))
+	defer backend.Close()
+
+	backendUrl, err := url.Parse(backend.URL)
+	assert.Nil(t, err)
+
+	router := newTestSingleUpstreamRouter(backendUrl, logger)
+	blo := NewBlobloProxy(router, &testObjectStorageCache{}, logger)
+	tBlobloServer := httptest.NewServer(blo)
+	defer tBlobloServer.Close()
+
+	client := http.Client{Timeout: 1 * time.Second}
+	cacheablePath := "/v2/blobs/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	resp, err := client.Get(fmt.Sprint(tBlobloServer.URL, cacheablePath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// One HEAD (to check upstream availability) and one GET (to fetch and
+	// cache the blob), both derived from the same inbound request and so
+	// carrying the same minted request ID.
+	assert.Len(t, capturedRequestIds, 2)
+	assert.NotEmpty(t, capturedRequestIds[0])
+	assert.Equal(t, capturedRequestIds[0], capturedRequestIds[1])
+}
+
 func TestClientIsRedirectedWhenBlobInCache(t *testing.T) {
 	fixture := newTestFixture(t)
 	defer fixture.tBlobloServer.Close()
@@ -171,6 +395,27 @@ func TestClientIsRedirectedWhenBlobInCache(t *testing.T) {
 	assert.True(t, fixture.cache.redirectedToPresignedUrl)
 }
 
+func TestBlobFailingDigestVerificationIsAborted(t *testing.T) {
+	fixture := newTestFixture(t)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	client := http.Client{
+		Timeout: 1 * time.Second,
+	}
+	// The test backend always serves "test response", which does not hash
+	// to this digest.
+	wrongDigestPath := "/v2/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, wrongDigestPath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.True(t, fixture.cache.abortedBlob)
+}
+
 func TestCustomCacheableFilter(t *testing.T) {
 	fixture := newTestFixture(t)
 	defer fixture.tBlobloServer.Close()
@@ -181,19 +426,123 @@ func TestCustomCacheableFilter(t *testing.T) {
 	}
 	requestPath := "/v2/blobs/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
 
-	fixture.tBloblo.isCacheableUri = func(requestURI string) bool {
-		return false
-	}
+	fixture.tBloblo.policy = CacheabilityPolicyFunc(func(req *http.Request, regPath registryPath) PolicyDecision {
+		return PolicyDecision{Action: PolicyActionBypass}
+	})
 	resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, requestPath))
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.False(t, fixture.cache.checkedForBlob)
 
-	fixture.tBloblo.isCacheableUri = func(requestURI string) bool {
-		return true
-	}
+	fixture.tBloblo.policy = CacheabilityPolicyFunc(func(req *http.Request, regPath registryPath) PolicyDecision {
+		return PolicyDecision{Action: PolicyActionCache}
+	})
 	resp, err = client.Get(fmt.Sprint(fixture.tBlobloServer.URL, requestPath))
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.True(t, fixture.cache.checkedForBlob)
 }
+
+func TestManifestIsUploadedToCacheWithContentType(t *testing.T) {
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	cache := &testObjectStorageCache{
+		defaultPresignedUrl: "http://localtest.me/a_presigned_url",
+	}
+
+	manifestDigest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	manifestBody := `{"schemaVersion":2}`
+	backendTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set(manifestDigestHeader, manifestDigest)
+		fmt.Fprint(w, manifestBody)
+	}))
+	defer backendTestServer.Close()
+	backendUrl, err := url.Parse(backendTestServer.URL)
+	assert.Nil(t, err)
+
+	router := newTestSingleUpstreamRouter(backendUrl, logger)
+	blo := NewBlobloProxy(router, cache, logger)
+	blobloServer := httptest.NewServer(blo)
+	defer blobloServer.Close()
+
+	client := http.Client{Timeout: 1 * time.Second}
+	manifestPath := "/v2/some/repo/manifests/latest"
+	resp, err := client.Get(fmt.Sprint(blobloServer.URL, manifestPath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, manifestBody, string(body))
+	assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, manifestDigest, resp.Header.Get(manifestDigestHeader))
+	assert.True(t, cache.uploadedBlob)
+
+	// A second request for the same manifest should be served from the
+	// cache instead of hitting the backend again.
+	resp, err = client.Get(fmt.Sprint(blobloServer.URL, manifestPath))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, manifestBody, string(body))
+	assert.Equal(t, 1, cache.getUploadCount())
+}
+
+func TestConcurrentCacheMissesCoalesceIntoOneUpload(t *testing.T) {
+	// Slow the backend down so the concurrent requests below actually
+	// overlap instead of racing through one at a time.
+	fixture := newTestFixtureWithBackendDelay(t, 100*time.Millisecond)
+	defer fixture.tBlobloServer.Close()
+	defer fixture.tBackend.server.Close()
+
+	// The cache's presigned URL points back at tBackend, the same content
+	// every follower should ultimately see - a real, fetchable target
+	// instead of a fake one, so a follower that redirects gets verifiable
+	// content rather than an unresolvable host masking what it actually
+	// received.
+	fixture.cache.defaultPresignedUrl = fixture.tBackend.server.URL
+
+	// The sha256 of the test backend's "test response" body, so the leader's
+	// fetch passes digest verification and followers get redirected.
+	cacheablePath := "/v2/blobs/sha256:3ed59d9f6e32da0f3c9784f5f1f178565b7627537b7be4314d2fcfe2d284f912"
+
+	const concurrentRequests = 10
+	var wg sync.WaitGroup
+	wg.Add(concurrentRequests)
+	bodies := make([]string, concurrentRequests)
+	errs := make([]error, concurrentRequests)
+	for i := 0; i < concurrentRequests; i++ {
+		go func(i int) {
+			defer wg.Done()
+			client := http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(fmt.Sprint(fixture.tBlobloServer.URL, cacheablePath))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			bodies[i] = string(body)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, fixture.cache.getUploadCount())
+	// Whether a request was the one that actually fetched from upstream or
+	// rode along someone else's fetch, every client must still get the full,
+	// correct blob - not an empty response from a misidentified leader, nor
+	// a response raced with a still-streaming write from a misidentified
+	// follower falling back to upstream.
+	for i := 0; i < concurrentRequests; i++ {
+		assert.Nil(t, errs[i], "request %d", i)
+		assert.Equal(t, fixture.tBackend.defaultResponse, bodies[i], "request %d", i)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// registryPath is a Docker Registry v2 request URI decomposed into the
+// parts a CacheabilityPolicy can match against.
+type registryPath struct {
+	Namespace string // e.g. "library" in "/v2/library/ubuntu/manifests/latest"
+	Name      string // e.g. "ubuntu" in the same example
+	Kind      string // "blobs" or "manifests"
+	Reference string // digest or tag
+}
+
+// parseRegistryPath decomposes a request URI into a registryPath. It
+// returns ok=false for anything that doesn't end in
+// .../<blobs|manifests>/<reference>.
+func parseRegistryPath(requestURI string) (path registryPath, ok bool) {
+	elements := strings.Split(strings.TrimPrefix(requestURI, "/"), "/")
+	if len(elements) < 3 || elements[0] != "v2" {
+		return registryPath{}, false
+	}
+
+	kind := elements[len(elements)-2]
+	if kind != "blobs" && kind != "manifests" {
+		return registryPath{}, false
+	}
+
+	nameElements := elements[1 : len(elements)-2]
+	namespace, name := "", strings.Join(nameElements, "/")
+	if len(nameElements) > 1 {
+		namespace, name = nameElements[0], strings.Join(nameElements[1:], "/")
+	}
+
+	return registryPath{
+		Namespace: namespace,
+		Name:      name,
+		Kind:      kind,
+		Reference: elements[len(elements)-1],
+	}, true
+}
+
+// PolicyAction is the disposition a CacheabilityPolicy assigns to a request.
+type PolicyAction string
+
+const (
+	PolicyActionCache  PolicyAction = "cache"
+	PolicyActionBypass PolicyAction = "bypass"
+	PolicyActionDeny   PolicyAction = "deny"
+)
+
+// PolicyDecision is what a CacheabilityPolicy returns for a request. TTL is
+// only meaningful alongside PolicyActionCache, and only when the matching
+// rule asked for one (cache_ttl=<duration>) - it's surfaced for callers
+// that want to expire cached objects early, not enforced by BlobloProxy
+// itself.
+type PolicyDecision struct {
+	Action PolicyAction
+	TTL    time.Duration
+}
+
+// CacheabilityPolicy decides what BlobloProxy should do with a request
+// against a cacheable-shaped path: serve it from cache, bypass the cache
+// and go straight to upstream, or deny it outright.
+type CacheabilityPolicy interface {
+	Evaluate(req *http.Request, regPath registryPath) PolicyDecision
+}
+
+// CacheabilityPolicyFunc adapts a plain function to a CacheabilityPolicy,
+// the way http.HandlerFunc adapts a function to an http.Handler.
+type CacheabilityPolicyFunc func(req *http.Request, regPath registryPath) PolicyDecision
+
+func (f CacheabilityPolicyFunc) Evaluate(req *http.Request, regPath registryPath) PolicyDecision {
+	return f(req, regPath)
+}
+
+// defaultCacheabilityPolicy reproduces bloblo's original behaviour: cache
+// every blob and manifest request, regardless of repository or caller.
+type defaultCacheabilityPolicy struct{}
+
+func (defaultCacheabilityPolicy) Evaluate(req *http.Request, regPath registryPath) PolicyDecision {
+	return PolicyDecision{Action: PolicyActionCache}
+}
+
+var _ CacheabilityPolicy = defaultCacheabilityPolicy{}
+
+// policyRule is one entry in a rules file. Rules are evaluated in file
+// order and the first one whose match block matches the request wins.
+type policyRule struct {
+	Match  policyMatch `yaml:"match" json:"match"`
+	Action string      `yaml:"action" json:"action"`
+}
+
+// policyMatch is a set of filters that all must pass for a rule to match.
+// A filter left empty always passes. Namespace and Name are glob patterns
+// (as in path.Match), Reference is a regular expression, Method is an
+// exact (case-insensitive) match, and User is a glob matched against the
+// authenticated username from HTTP Basic Auth - the literal value
+// "anonymous" matches requests with no Basic Auth at all.
+type policyMatch struct {
+	Namespace string `yaml:"namespace" json:"namespace"`
+	Name      string `yaml:"name" json:"name"`
+	Reference string `yaml:"reference" json:"reference"`
+	Method    string `yaml:"method" json:"method"`
+	User      string `yaml:"user" json:"user"`
+}
+
+func (m policyMatch) matches(req *http.Request, regPath registryPath) bool {
+	if m.Namespace != "" && !globMatch(m.Namespace, regPath.Namespace) {
+		return false
+	}
+	if m.Name != "" && !globMatch(m.Name, regPath.Name) {
+		return false
+	}
+	if m.Reference != "" {
+		matched, err := regexp.MatchString(m.Reference, regPath.Reference)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.User != "" {
+		user, _, hasAuth := req.BasicAuth()
+		if m.User == "anonymous" {
+			if hasAuth {
+				return false
+			}
+		} else if !hasAuth || !globMatch(m.User, user) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func globMatch(pattern, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// parsePolicyAction turns a rule's action string ("cache", "bypass",
+// "deny", or "cache_ttl=<duration>") into a PolicyDecision.
+func parsePolicyAction(action string) (PolicyDecision, error) {
+	if ttlStr, ok := strings.CutPrefix(action, "cache_ttl="); ok {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return PolicyDecision{}, fmt.Errorf("invalid cache_ttl duration %q: %w", ttlStr, err)
+		}
+		return PolicyDecision{Action: PolicyActionCache, TTL: ttl}, nil
+	}
+
+	switch PolicyAction(action) {
+	case PolicyActionCache, PolicyActionBypass, PolicyActionDeny:
+		return PolicyDecision{Action: PolicyAction(action)}, nil
+	default:
+		return PolicyDecision{}, fmt.Errorf("unknown policy action %q", action)
+	}
+}
+
+type compiledRule struct {
+	match    policyMatch
+	decision PolicyDecision
+}
+
+// RulePolicy is a CacheabilityPolicy backed by a YAML or JSON rules file
+// (picked by its extension), reloaded whenever the process receives
+// SIGHUP so operators can retune cacheability without restarting bloblo.
+// Requests that match no rule fall through to a fallback policy.
+type RulePolicy struct {
+	path     string
+	fallback CacheabilityPolicy
+	logger   *zap.Logger
+
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+func NewRulePolicy(rulesPath string, fallback CacheabilityPolicy, logger *zap.Logger) (*RulePolicy, error) {
+	rp := &RulePolicy{path: rulesPath, fallback: fallback, logger: logger}
+	if err := rp.reload(); err != nil {
+		return nil, err
+	}
+
+	rp.watchForReloadSignal()
+	return rp, nil
+}
+
+func (rp *RulePolicy) reload() error {
+	data, err := os.ReadFile(rp.path)
+	if err != nil {
+		return fmt.Errorf("reading cacheability rules %s: %w", rp.path, err)
+	}
+
+	var rawRules []policyRule
+	if strings.HasSuffix(rp.path, ".json") {
+		err = json.Unmarshal(data, &rawRules)
+	} else {
+		err = yaml.Unmarshal(data, &rawRules)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing cacheability rules %s: %w", rp.path, err)
+	}
+
+	compiled := make([]compiledRule, len(rawRules))
+	for i, rule := range rawRules {
+		decision, err := parsePolicyAction(rule.Action)
+		if err != nil {
+			return fmt.Errorf("rule %d in %s: %w", i, rp.path, err)
+		}
+		compiled[i] = compiledRule{match: rule.Match, decision: decision}
+	}
+
+	rp.mu.Lock()
+	rp.rules = compiled
+	rp.mu.Unlock()
+	return nil
+}
+
+// watchForReloadSignal reloads the rules file on every SIGHUP. A bad
+// reload (e.g. a typo in the file) is logged and the previous rules keep
+// running rather than taking the proxy down.
+func (rp *RulePolicy) watchForReloadSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			if err := rp.reload(); err != nil {
+				rp.logger.Error("Failed to reload cacheability rules", zap.String("path", rp.path), zap.String("error", err.Error()))
+				continue
+			}
+			rp.logger.Info("Reloaded cacheability rules", zap.String("path", rp.path))
+		}
+	}()
+}
+
+func (rp *RulePolicy) Evaluate(req *http.Request, regPath registryPath) PolicyDecision {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	for _, rule := range rp.rules {
+		if rule.match.matches(req, regPath) {
+			return rule.decision
+		}
+	}
+
+	return rp.fallback.Evaluate(req, regPath)
+}
+
+var _ CacheabilityPolicy = (*RulePolicy)(nil)
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const rulePolicyTestRules = `
+- match:
+    name: private-*
+  action: deny
+- match:
+    namespace: ci
+    user: anonymous
+  action: cache_ttl=1h
+- match:
+    namespace: ci
+  action: bypass
+- match:
+    namespace: library
+  action: cache
+`
+
+func newTestRulePolicy(t *testing.T, contents string) *RulePolicy {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0o644))
+
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	rp, err := NewRulePolicy(path, defaultCacheabilityPolicy{}, logger)
+	assert.Nil(t, err)
+	return rp
+}
+
+func TestRulePolicyPrecedence(t *testing.T) {
+	rp := newTestRulePolicy(t, rulePolicyTestRules)
+
+	anonReq := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	authedReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	authedReq.SetBasicAuth("alice", "s3cr3t")
+
+	cases := []struct {
+		name         string
+		req          *http.Request
+		path         registryPath
+		wantDecision PolicyDecision
+	}{
+		{
+			name:         "private repos are denied regardless of namespace",
+			req:          anonReq,
+			path:         registryPath{Namespace: "library", Name: "private-stuff", Kind: "blobs", Reference: "sha256:abc"},
+			wantDecision: PolicyDecision{Action: PolicyActionDeny},
+		},
+		{
+			name:         "anonymous ci traffic is cached with a ttl",
+			req:          anonReq,
+			path:         registryPath{Namespace: "ci", Name: "builder", Kind: "manifests", Reference: "latest"},
+			wantDecision: PolicyDecision{Action: PolicyActionCache, TTL: time.Hour},
+		},
+		{
+			name:         "authenticated ci traffic bypasses the cache",
+			req:          authedReq,
+			path:         registryPath{Namespace: "ci", Name: "builder", Kind: "manifests", Reference: "latest"},
+			wantDecision: PolicyDecision{Action: PolicyActionBypass},
+		},
+		{
+			name:         "library is cached",
+			req:          anonReq,
+			path:         registryPath{Namespace: "library", Name: "ubuntu", Kind: "blobs", Reference: "sha256:abc"},
+			wantDecision: PolicyDecision{Action: PolicyActionCache},
+		},
+		{
+			name:         "unmatched namespace falls through to the default policy",
+			req:          anonReq,
+			path:         registryPath{Namespace: "myorg", Name: "app", Kind: "blobs", Reference: "sha256:abc"},
+			wantDecision: PolicyDecision{Action: PolicyActionCache},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.wantDecision, rp.Evaluate(c.req, c.path))
+		})
+	}
+}
+
+func TestRulePolicyHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+- match:
+    namespace: library
+  action: bypass
+`), 0o644))
+
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	rp, err := NewRulePolicy(path, defaultCacheabilityPolicy{}, logger)
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	libraryPath := registryPath{Namespace: "library", Name: "ubuntu", Kind: "blobs", Reference: "sha256:abc"}
+
+	assert.Equal(t, PolicyDecision{Action: PolicyActionBypass}, rp.Evaluate(req, libraryPath))
+
+	assert.Nil(t, os.WriteFile(path, []byte(`
+- match:
+    namespace: library
+  action: cache
+`), 0o644))
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	assert.Eventually(t, func() bool {
+		return rp.Evaluate(req, libraryPath).Action == PolicyActionCache
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestRulePolicyBadReloadKeepsPreviousRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+- match:
+    namespace: library
+  action: cache
+`), 0o644))
+
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	logger := zap.New(observedZapCore)
+
+	rp, err := NewRulePolicy(path, defaultCacheabilityPolicy{}, logger)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`not: [valid`), 0o644))
+	assert.NotNil(t, rp.reload())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	libraryPath := registryPath{Namespace: "library", Name: "ubuntu", Kind: "blobs", Reference: "sha256:abc"}
+	assert.Equal(t, PolicyDecision{Action: PolicyActionCache}, rp.Evaluate(req, libraryPath))
+}
+
+func TestParseRegistryPath(t *testing.T) {
+	cases := []struct {
+		uri      string
+		wantOk   bool
+		wantPath registryPath
+	}{
+		{
+			uri:      "/v2/blobs/sha256:abc",
+			wantOk:   true,
+			wantPath: registryPath{Kind: "blobs", Reference: "sha256:abc"},
+		},
+		{
+			uri:      "/v2/library/ubuntu/manifests/latest",
+			wantOk:   true,
+			wantPath: registryPath{Namespace: "library", Name: "ubuntu", Kind: "manifests", Reference: "latest"},
+		},
+		{
+			uri:    "/some/blob/lo",
+			wantOk: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.uri, func(t *testing.T) {
+			gotPath, ok := parseRegistryPath(c.uri)
+			assert.Equal(t, c.wantOk, ok)
+			if c.wantOk {
+				assert.Equal(t, c.wantPath, gotPath)
+			}
+		})
+	}
+}
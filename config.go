@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is bloblo's full configuration. It can be loaded from a single
+// BLOBLO_CONFIG file (YAML or JSON, picked by extension) so operators
+// managing many upstreams don't have to keep a pile of BLOBLO_* env vars in
+// sync - but every field except Routes can still be set or overridden by
+// its matching env var, which always wins over the file. That keeps secrets (credentials,
+// connection strings) in the environment even when the rest of the config
+// is checked into a repo.
+type Config struct {
+	ListenAddr   string `yaml:"listen_addr" json:"listen_addr"`
+	UpstreamURL  string `yaml:"upstream_url" json:"upstream_url"`
+	PreserveHost bool   `yaml:"preserve_host" json:"preserve_host"`
+
+	CacheBackend             string `yaml:"cache_backend" json:"cache_backend"`
+	PresignExpirationMinutes int    `yaml:"presign_expiration_minutes" json:"presign_expiration_minutes"`
+
+	S3    S3Config    `yaml:"s3" json:"s3"`
+	FS    FSConfig    `yaml:"fs" json:"fs"`
+	GCS   GCSConfig   `yaml:"gcs" json:"gcs"`
+	Azure AzureConfig `yaml:"azure" json:"azure"`
+
+	// Routes sends requests for a matching repository to a different
+	// upstream than UpstreamURL, so one bloblo can front several
+	// registries. Only settable via BLOBLO_CONFIG - there's no sane way
+	// to express a list of routes as a single env var.
+	Routes []RouteConfig `yaml:"routes" json:"routes"`
+
+	// CacheabilityRulesPath is the path to a RulePolicy rules file. It is
+	// itself hot-reloaded on SIGHUP already (see cacheability_policy.go);
+	// here it's just one more setting that can come from either source.
+	CacheabilityRulesPath string `yaml:"cacheability_rules_path" json:"cacheability_rules_path"`
+
+	MetricsAddr string `yaml:"metrics_addr" json:"metrics_addr"`
+
+	Audit AuditConfig `yaml:"audit" json:"audit"`
+}
+
+type S3Config struct {
+	BucketName string `yaml:"bucket_name" json:"bucket_name"`
+	// Endpoint, when set, points the s3 (and minio) backends at a non-AWS,
+	// S3-compatible endpoint such as MinIO, Ceph or Wasabi, instead of
+	// real AWS S3.
+	Endpoint       string `yaml:"endpoint" json:"endpoint"`
+	Region         string `yaml:"region" json:"region"`
+	ForcePathStyle bool   `yaml:"force_path_style" json:"force_path_style"`
+
+	// Prefix, when set, puts every object bloblo stores under this
+	// subpath, so a bucket can be shared with other tools without key
+	// collisions (mirrors restic's own S3 Prefix setting).
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// KeyLayout picks how blob digests map to S3 object keys: "flat"
+	// (the default - digest directly under Prefix) or "fanout" (sharded
+	// into <algo>/<first 2 hex>/<next 2 hex>/<digest> subdirectories, to
+	// avoid listing hot-spots on buckets with very many objects).
+	KeyLayout string `yaml:"key_layout" json:"key_layout"`
+
+	// AccessKeyID, SecretAccessKey and SessionToken pin bloblo to a static
+	// set of credentials instead of the AWS SDK's default provider chain
+	// (env vars, EC2 instance profile, ECS task role, EKS IRSA web
+	// identity, ...). Leave these unset outside of the rare deployment
+	// that genuinely can't use any of those - the default chain already
+	// covers instance/task/pod-level credentials and refreshes them as
+	// they expire.
+	AccessKeyID     string `yaml:"access_key_id" json:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" json:"secret_access_key"`
+	SessionToken    string `yaml:"session_token" json:"session_token"`
+
+	// DisableTagging turns off the bloblo-upstream/bloblo-repo/
+	// bloblo-digest-algo/bloblo-cached-at object tags bloblo otherwise
+	// sets on every upload, for operators who haven't granted
+	// s3:PutObjectTagging or who don't want the tags. Has no effect on
+	// the non-S3 backends, which never tag objects to begin with.
+	DisableTagging bool `yaml:"disable_tagging" json:"disable_tagging"`
+}
+
+type FSConfig struct {
+	Root string `yaml:"root" json:"root"`
+}
+
+// RouteConfig is one entry in Config.Routes. Prefix is a path.Match glob
+// tested against "<namespace>/<name>" (e.g. "myorg/*"); Name identifies
+// the route and namespaces its cache keys. S3BucketName is optional and
+// only valid alongside cache_backend: s3 (or minio) - it gives the route
+// its own bucket instead of sharing the default cache.
+type RouteConfig struct {
+	Name         string `yaml:"name" json:"name"`
+	Prefix       string `yaml:"prefix" json:"prefix"`
+	UpstreamURL  string `yaml:"upstream_url" json:"upstream_url"`
+	PreserveHost bool   `yaml:"preserve_host" json:"preserve_host"`
+	S3BucketName string `yaml:"s3_bucket_name" json:"s3_bucket_name"`
+}
+
+type GCSConfig struct {
+	BucketName      string `yaml:"bucket_name" json:"bucket_name"`
+	CredentialsFile string `yaml:"credentials_file" json:"credentials_file"`
+}
+
+type AzureConfig struct {
+	ContainerName    string `yaml:"container_name" json:"container_name"`
+	ConnectionString string `yaml:"connection_string" json:"connection_string"`
+}
+
+type AuditConfig struct {
+	Backend    string `yaml:"backend" json:"backend"`
+	FilePath   string `yaml:"file_path" json:"file_path"`
+	MaxBytes   int64  `yaml:"max_bytes" json:"max_bytes"`
+	SyslogAddr string `yaml:"syslog_addr" json:"syslog_addr"`
+	FluentHost string `yaml:"fluent_host" json:"fluent_host"`
+	FluentPort string `yaml:"fluent_port" json:"fluent_port"`
+	FluentTag  string `yaml:"fluent_tag" json:"fluent_tag"`
+}
+
+// defaultConfig returns the config bloblo has always shipped with when
+// nothing is set, env vars or file alike.
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:               ":7777",
+		UpstreamURL:              "http://localhost:7000",
+		CacheBackend:             "s3",
+		PresignExpirationMinutes: 5,
+		S3: S3Config{
+			BucketName:     "sample-bucket",
+			Region:         "us-east-1",
+			ForcePathStyle: true,
+			KeyLayout:      "flat",
+		},
+		FS: FSConfig{
+			Root: "/var/lib/bloblo/cache",
+		},
+		MetricsAddr: ":9090",
+		Audit: AuditConfig{
+			FilePath:   "/var/log/bloblo/audit.jsonl",
+			MaxBytes:   defaultAuditMaxBytes,
+			SyslogAddr: "localhost:514",
+			FluentHost: "localhost",
+			FluentPort: "24224",
+			FluentTag:  "bloblo.audit",
+		},
+	}
+}
+
+// loadConfigFile reads a YAML or JSON config file (picked by extension, the
+// same convention cacheability_policy.go uses for its rules file) onto a
+// copy of defaultConfig, so fields the file leaves out keep their defaults.
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	cfg := defaultConfig()
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, cfg)
+	} else {
+		err = yaml.Unmarshal(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// applyEnvOverrides overlays the BLOBLO_* env vars bloblo has always read
+// onto cfg, env winning over whatever the file (or the defaults) set. A
+// field is only touched when its env var is actually present, so a config
+// file value survives when the matching env var is unset.
+func applyEnvOverrides(cfg *Config) {
+	if v, ok := os.LookupEnv("BLOBLO_LISTEN_ADDR"); ok {
+		cfg.ListenAddr = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_UPSTREAM_URL"); ok {
+		cfg.UpstreamURL = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_PRESERVE_HOST"); ok {
+		cfg.PreserveHost = v == "true"
+	}
+	if v, ok := os.LookupEnv("BLOBLO_CACHE_BACKEND"); ok {
+		cfg.CacheBackend = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_PRESIGN_EXPIRATION_MINUTES"); ok {
+		if parsed, err := strconv.Atoi(v); err == nil {
+			cfg.PresignExpirationMinutes = parsed
+		}
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_S3_BUCKET_NAME"); ok {
+		cfg.S3.BucketName = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_ENDPOINT"); ok {
+		cfg.S3.Endpoint = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_REGION"); ok {
+		cfg.S3.Region = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_FORCE_PATH_STYLE"); ok {
+		cfg.S3.ForcePathStyle = v != "false"
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_PREFIX"); ok {
+		cfg.S3.Prefix = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_KEY_LAYOUT"); ok {
+		cfg.S3.KeyLayout = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_ACCESS_KEY_ID"); ok {
+		cfg.S3.AccessKeyID = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_SECRET_ACCESS_KEY"); ok {
+		cfg.S3.SecretAccessKey = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_SESSION_TOKEN"); ok {
+		cfg.S3.SessionToken = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_S3_DISABLE_TAGGING"); ok {
+		cfg.S3.DisableTagging = v == "true"
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_FS_ROOT"); ok {
+		cfg.FS.Root = v
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_GCS_BUCKET_NAME"); ok {
+		cfg.GCS.BucketName = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_GCS_CREDENTIALS_FILE"); ok {
+		cfg.GCS.CredentialsFile = v
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_AZURE_CONTAINER_NAME"); ok {
+		cfg.Azure.ContainerName = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_AZURE_CONNECTION_STRING"); ok {
+		cfg.Azure.ConnectionString = v
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_CACHEABILITY_RULES_PATH"); ok {
+		cfg.CacheabilityRulesPath = v
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_METRICS_ADDR"); ok {
+		cfg.MetricsAddr = v
+	}
+
+	if v, ok := os.LookupEnv("BLOBLO_AUDIT"); ok {
+		cfg.Audit.Backend = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_AUDIT_FILE_PATH"); ok {
+		cfg.Audit.FilePath = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_AUDIT_FILE_MAX_BYTES"); ok {
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.Audit.MaxBytes = parsed
+		}
+	}
+	if v, ok := os.LookupEnv("BLOBLO_SYSLOG_ADDR"); ok {
+		cfg.Audit.SyslogAddr = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_FLUENT_HOST"); ok {
+		cfg.Audit.FluentHost = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_FLUENT_PORT"); ok {
+		cfg.Audit.FluentPort = v
+	}
+	if v, ok := os.LookupEnv("BLOBLO_FLUENT_TAG"); ok {
+		cfg.Audit.FluentTag = v
+	}
+}
+
+// loadConfig builds the effective Config: BLOBLO_CONFIG if set, defaults
+// otherwise, with the BLOBLO_* env vars applied on top either way.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("BLOBLO_CONFIG"); path != "" {
+		fileCfg, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg = fileCfg
+	}
+
+	applyEnvOverrides(cfg)
+	return cfg, nil
+}
+
+func (cfg *Config) presignExpiration() time.Duration {
+	return time.Duration(cfg.PresignExpirationMinutes) * time.Minute
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func TestLoadConfigFallsBackToDefaultsWithoutAConfigFile(t *testing.T) {
+	os.Unsetenv("BLOBLO_CONFIG")
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultConfig(), cfg)
+}
+
+func TestLoadConfigReadsYamlFile(t *testing.T) {
+	path := writeConfigFile(t, "bloblo.yaml", `
+upstream_url: https://registry.example.com
+cache_backend: gcs
+presign_expiration_minutes: 15
+gcs:
+  bucket_name: my-bucket
+  credentials_file: /etc/bloblo/gcs.json
+`)
+	t.Setenv("BLOBLO_CONFIG", path)
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://registry.example.com", cfg.UpstreamURL)
+	assert.Equal(t, "gcs", cfg.CacheBackend)
+	assert.Equal(t, 15, cfg.PresignExpirationMinutes)
+	assert.Equal(t, "my-bucket", cfg.GCS.BucketName)
+	// fields the file didn't set keep their defaults
+	assert.Equal(t, ":7777", cfg.ListenAddr)
+}
+
+func TestLoadConfigReadsJsonFile(t *testing.T) {
+	path := writeConfigFile(t, "bloblo.json", `{"cache_backend": "azure", "azure": {"container_name": "blobs"}}`)
+	t.Setenv("BLOBLO_CONFIG", path)
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "azure", cfg.CacheBackend)
+	assert.Equal(t, "blobs", cfg.Azure.ContainerName)
+}
+
+func TestLoadConfigEnvVarsOverrideTheFile(t *testing.T) {
+	path := writeConfigFile(t, "bloblo.yaml", `
+cache_backend: s3
+s3:
+  bucket_name: file-bucket
+`)
+	t.Setenv("BLOBLO_CONFIG", path)
+	t.Setenv("BLOBLO_S3_BUCKET_NAME", "env-bucket")
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "s3", cfg.CacheBackend)
+	assert.Equal(t, "env-bucket", cfg.S3.BucketName)
+}
+
+func TestLoadConfigEnvVarsSetTheS3PrefixAndKeyLayout(t *testing.T) {
+	os.Unsetenv("BLOBLO_CONFIG")
+	t.Setenv("BLOBLO_S3_PREFIX", "bloblo")
+	t.Setenv("BLOBLO_S3_KEY_LAYOUT", "fanout")
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "bloblo", cfg.S3.Prefix)
+	assert.Equal(t, "fanout", cfg.S3.KeyLayout)
+}
+
+func TestLoadConfigEnvVarsSetTheS3StaticCredentials(t *testing.T) {
+	os.Unsetenv("BLOBLO_CONFIG")
+	t.Setenv("BLOBLO_S3_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("BLOBLO_S3_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("BLOBLO_S3_SESSION_TOKEN", "token")
+
+	cfg, err := loadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIAEXAMPLE", cfg.S3.AccessKeyID)
+	assert.Equal(t, "secret", cfg.S3.SecretAccessKey)
+	assert.Equal(t, "token", cfg.S3.SessionToken)
+}
+
+func TestLoadConfigMissingFileIsAnError(t *testing.T) {
+	t.Setenv("BLOBLO_CONFIG", filepath.Join(t.TempDir(), "does-not-exist.yaml"))
+
+	_, err := loadConfig()
+	assert.NotNil(t, err)
+}
+
+func TestApplyEnvOverridesOnlyTouchesSetVars(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.S3.ForcePathStyle = true
+	cfg.S3.BucketName = "file-bucket"
+
+	t.Setenv("BLOBLO_S3_FORCE_PATH_STYLE", "false")
+	os.Unsetenv("BLOBLO_S3_BUCKET_NAME")
+	applyEnvOverrides(cfg)
+	assert.False(t, cfg.S3.ForcePathStyle)
+	assert.Equal(t, "file-bucket", cfg.S3.BucketName)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// splitDigest splits an OCI-style digest ("sha256:abcd...") into its
+// algorithm and hex-encoded halves.
+func splitDigest(blobDigest string) (algo, hexDigest string, err error) {
+	parts := strings.SplitN(blobDigest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid digest %q: expected <algo>:<hex>", blobDigest)
+	}
+	return parts[0], parts[1], nil
+}
+
+// newDigestHasher returns a hash.Hash matching the algorithm encoded in
+// blobDigest, plus the hex half to verify against once the hash is final.
+func newDigestHasher(blobDigest string) (h hash.Hash, hexDigest string, err error) {
+	algo, hexDigest, err := splitDigest(blobDigest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch algo {
+	case "sha256":
+		return sha256.New(), hexDigest, nil
+	case "sha512":
+		return sha512.New(), hexDigest, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported digest algorithm %q", algo)
+	}
+}
+
+// verifyDigest reports whether h's current sum matches wantHex.
+func verifyDigest(h hash.Hash, wantHex string) bool {
+	return hex.EncodeToString(h.Sum(nil)) == wantHex
+}
+
+// hexDigestToBase64 converts a hex-encoded digest into the base64 form S3
+// uses for its ChecksumSHA256 object attribute, so the two can be compared.
+func hexDigestToBase64(hexDigest string) (string, error) {
+	raw, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// DynamicObjectStorageCache is an ObjectStorageCache that forwards every
+// call to whichever backend is currently loaded, so a config reload can
+// swap credentials, buckets or even the backend type itself without
+// BlobloProxy - which holds a DynamicObjectStorageCache for the lifetime
+// of the process - ever needing to know.
+type DynamicObjectStorageCache struct {
+	current atomic.Pointer[ObjectStorageCache]
+}
+
+// NewDynamicObjectStorageCache wraps an initial backend.
+func NewDynamicObjectStorageCache(cache ObjectStorageCache) *DynamicObjectStorageCache {
+	dynamic := &DynamicObjectStorageCache{}
+	dynamic.Store(cache)
+	return dynamic
+}
+
+// Store atomically swaps in a new backend. In-flight calls against the
+// previous backend run to completion; only calls made after Store returns
+// see the new one.
+func (dynamic *DynamicObjectStorageCache) Store(cache ObjectStorageCache) {
+	dynamic.current.Store(&cache)
+}
+
+func (dynamic *DynamicObjectStorageCache) load() ObjectStorageCache {
+	return *dynamic.current.Load()
+}
+
+// Backend returns the currently loaded backend, for callers (like the
+// audit trail) that want to identify it rather than just use it.
+func (dynamic *DynamicObjectStorageCache) Backend() ObjectStorageCache {
+	return dynamic.load()
+}
+
+func (dynamic *DynamicObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	return dynamic.load().getPresignedUrl(blobDigest)
+}
+
+func (dynamic *DynamicObjectStorageCache) isBlobInCache(blobDigest string) (bool, error) {
+	return dynamic.load().isBlobInCache(blobDigest)
+}
+
+func (dynamic *DynamicObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	return dynamic.load().uploadBlob(blobDigest, body, meta, tags)
+}
+
+func (dynamic *DynamicObjectStorageCache) abortBlob(blobDigest string) error {
+	return dynamic.load().abortBlob(blobDigest)
+}
+
+func (dynamic *DynamicObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	return dynamic.load().getBlob(blobDigest)
+}
+
+func (dynamic *DynamicObjectStorageCache) Ping(ctx context.Context) error {
+	return dynamic.load().Ping(ctx)
+}
+
+// ServeBlob delegates to the currently loaded backend when it's a
+// localBlobServer (e.g. the filesystem backend), so BlobloProxy.serveLocalBlob
+// can keep doing a plain type assertion against its cache without needing
+// to unwrap DynamicObjectStorageCache itself.
+func (dynamic *DynamicObjectStorageCache) ServeBlob(w http.ResponseWriter, req *http.Request, blobDigest string) error {
+	server, ok := dynamic.load().(localBlobServer)
+	if !ok {
+		return fmt.Errorf("current backend does not support serving blobs locally")
+	}
+	return server.ServeBlob(w, req, blobDigest)
+}
+
+// Make sure DynamicObjectStorageCache implements the ObjectStorageCache interface
+var _ ObjectStorageCache = (*DynamicObjectStorageCache)(nil)
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamicObjectStorageCacheForwardsToTheStoredBackend(t *testing.T) {
+	first := &testObjectStorageCache{defaultPresignedUrl: "http://localtest.me/first"}
+	dynamic := NewDynamicObjectStorageCache(first)
+
+	url, err := dynamic.getPresignedUrl("digest")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localtest.me/first", url)
+
+	second := &testObjectStorageCache{defaultPresignedUrl: "http://localtest.me/second"}
+	dynamic.Store(second)
+
+	url, err = dynamic.getPresignedUrl("digest")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localtest.me/second", url)
+}
+
+func TestCacheBackendNameUnwrapsADynamicCache(t *testing.T) {
+	dynamic := NewDynamicObjectStorageCache(&testObjectStorageCache{})
+	assert.Equal(t, "testObjectStorageCache", cacheBackendName(dynamic))
+}
+
+func TestDynamicObjectStorageCacheServeBlobDelegatesToTheBackend(t *testing.T) {
+	fsCache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	assert.Nil(t, fsCache.uploadBlob(digest, strings.NewReader("hello bloblo"), nil, nil))
+
+	dynamic := NewDynamicObjectStorageCache(fsCache)
+	req := httptest.NewRequest("GET", "/_bloblo_cache/"+digest, nil)
+	rec := httptest.NewRecorder()
+
+	assert.Nil(t, dynamic.ServeBlob(rec, req, digest))
+	assert.Equal(t, "hello bloblo", rec.Body.String())
+}
+
+func TestDynamicObjectStorageCacheServeBlobErrorsWhenBackendCannotServeLocally(t *testing.T) {
+	dynamic := NewDynamicObjectStorageCache(&testObjectStorageCache{})
+	rec := httptest.NewRecorder()
+
+	assert.NotNil(t, dynamic.ServeBlob(rec, httptest.NewRequest("GET", "/_bloblo_cache/digest", nil), "digest"))
+}
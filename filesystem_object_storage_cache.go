@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fsShardPrefixLen is how many hex characters of the digest are used to
+// shard blobs into subdirectories, so a single directory never ends up
+// holding every cached object.
+const fsShardPrefixLen = 4
+
+// FilesystemObjectStorageCache stores cached blobs as plain files under a
+// configurable root directory. It exists for operators who want to run
+// bloblo without any S3 dependency, e.g. a single-node or air-gapped setup.
+type FilesystemObjectStorageCache struct {
+	root string
+}
+
+func NewFilesystemObjectStorageCache(root string) (*FilesystemObjectStorageCache, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FilesystemObjectStorageCache{root: root}, nil
+}
+
+// blobKey turns a digest such as "sha256:abcd..." into a filesystem-safe
+// name, since colons are awkward in paths on some platforms.
+func blobKey(blobDigest string) string {
+	return strings.ReplaceAll(blobDigest, ":", "_")
+}
+
+func (fsCache *FilesystemObjectStorageCache) pathFor(blobDigest string) string {
+	key := blobKey(blobDigest)
+
+	_, hexDigest, err := splitDigest(blobDigest)
+	if err != nil || len(hexDigest) < fsShardPrefixLen {
+		// Nothing we can shard on (e.g. a malformed reference) - fall back
+		// to flat so it still resolves to a consistent path.
+		return filepath.Join(fsCache.root, key)
+	}
+
+	return filepath.Join(fsCache.root, hexDigest[:fsShardPrefixLen], key)
+}
+
+// getPresignedUrl has no presigned URL to hand out for the local
+// filesystem, so it returns a self-hosted URL that BlobloProxy serves
+// itself via its /_bloblo_cache/ handler.
+func (fsCache *FilesystemObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	return fmt.Sprint(localCachePathPrefix, blobDigest), nil
+}
+
+func (fsCache *FilesystemObjectStorageCache) isBlobInCache(blobDigest string) (isInCache bool, err error) {
+	_, err = os.Stat(fsCache.pathFor(blobDigest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (fsCache *FilesystemObjectStorageCache) metaPathFor(blobDigest string) string {
+	return fsCache.pathFor(blobDigest) + ".meta.json"
+}
+
+// uploadBlob ignores tags - there's no tagging concept for plain files on
+// disk.
+func (fsCache *FilesystemObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	path := fsCache.pathFor(blobDigest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a reader can never observe a
+	// partially-written blob through isBlobInCache/ServeBlob.
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	if len(meta) == 0 {
+		return nil
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fsCache.metaPathFor(blobDigest), metaBytes, 0o644)
+}
+
+// abortBlob removes a blob that turned out to be corrupt.
+func (fsCache *FilesystemObjectStorageCache) abortBlob(blobDigest string) error {
+	err := os.Remove(fsCache.pathFor(blobDigest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(fsCache.metaPathFor(blobDigest))
+	return nil
+}
+
+// getBlob returns the cached body and any metadata recorded at upload time.
+func (fsCache *FilesystemObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	f, err := os.Open(fsCache.pathFor(blobDigest))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := map[string]string{}
+	if metaBytes, err := os.ReadFile(fsCache.metaPathFor(blobDigest)); err == nil {
+		json.Unmarshal(metaBytes, &meta)
+	}
+
+	return f, meta, nil
+}
+
+// ServeBlob serves a cached blob directly, letting http.ServeContent take
+// care of Range, If-None-Match (the digest doubles as the ETag) and HEAD.
+func (fsCache *FilesystemObjectStorageCache) ServeBlob(w http.ResponseWriter, req *http.Request, blobDigest string) error {
+	f, err := os.Open(fsCache.pathFor(blobDigest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("%q", blobDigest))
+	http.ServeContent(w, req, blobDigest, info.ModTime(), f)
+	return nil
+}
+
+// Ping confirms the cache root still exists and is a directory. It does
+// not check that bloblo can read or write under it.
+func (fsCache *FilesystemObjectStorageCache) Ping(ctx context.Context) error {
+	info, err := os.Stat(fsCache.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", fsCache.root)
+	}
+	return nil
+}
+
+// Make sure FilesystemObjectStorageCache implements the ObjectStorageCache interface
+var _ ObjectStorageCache = (*FilesystemObjectStorageCache)(nil)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemCacheUploadAndServe(t *testing.T) {
+	cache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+
+	isInCache, err := cache.isBlobInCache(digest)
+	assert.Nil(t, err)
+	assert.False(t, isInCache)
+
+	err = cache.uploadBlob(digest, strings.NewReader("hello bloblo"), nil, nil)
+	assert.Nil(t, err)
+
+	isInCache, err = cache.isBlobInCache(digest)
+	assert.Nil(t, err)
+	assert.True(t, isInCache)
+
+	presignedUrl, err := cache.getPresignedUrl(digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "/_bloblo_cache/"+digest, presignedUrl)
+}
+
+func TestFilesystemCacheServeBlobSupportsRangeAndETag(t *testing.T) {
+	cache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	assert.Nil(t, cache.uploadBlob(digest, strings.NewReader("hello bloblo"), nil, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/_bloblo_cache/"+digest, nil)
+	req.Header.Set("Range", "bytes=0-4")
+	rec := httptest.NewRecorder()
+
+	assert.Nil(t, cache.ServeBlob(rec, req, digest))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.Equal(t, `"`+digest+`"`, rec.Header().Get("ETag"))
+}
+
+func TestFilesystemCachePingFailsWhenRootIsGone(t *testing.T) {
+	root := t.TempDir()
+	cache, err := NewFilesystemObjectStorageCache(root)
+	assert.Nil(t, err)
+
+	assert.Nil(t, cache.Ping(context.Background()))
+
+	assert.Nil(t, os.RemoveAll(root))
+	assert.NotNil(t, cache.Ping(context.Background()))
+}
+
+func TestFilesystemCachePingFailsWhenRootIsAFile(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "not-a-dir")
+	assert.Nil(t, os.WriteFile(root, []byte("oops"), 0o644))
+
+	cache := &FilesystemObjectStorageCache{root: root}
+	assert.NotNil(t, cache.Ping(context.Background()))
+}
+
+func TestFilesystemCachePathForShardsOnTheHexDigestNotTheAlgorithmPrefix(t *testing.T) {
+	cache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	shardOf := func(blobDigest string) string {
+		return filepath.Base(filepath.Dir(cache.pathFor(blobDigest)))
+	}
+
+	// Same algorithm, different hex digests: the bug being fixed here was
+	// that the shard was derived from "sha256_" (the algorithm prefix
+	// shared by every digest), so every blob collapsed into one directory.
+	shardA := shardOf("sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd")
+	shardB := shardOf("sha256:ab2c5e1f6a6f008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd")
+	assert.NotEqual(t, shardA, shardB)
+	assert.Equal(t, "891b", shardA)
+	assert.Equal(t, "ab2c", shardB)
+}
+
+func TestFilesystemCachePathForFallsBackToFlatForUnshardableDigests(t *testing.T) {
+	cache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	path := cache.pathFor("not-a-valid-digest")
+	assert.Equal(t, filepath.Join(cache.root, blobKey("not-a-valid-digest")), path)
+}
+
+func TestFilesystemCacheGetBlobReturnsMetadata(t *testing.T) {
+	cache, err := NewFilesystemObjectStorageCache(t.TempDir())
+	assert.Nil(t, err)
+
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	meta := map[string]string{"Content-Type": "application/vnd.oci.image.manifest.v1+json"}
+	assert.Nil(t, cache.uploadBlob(digest, strings.NewReader("hello bloblo"), meta, nil))
+
+	body, gotMeta, err := cache.getBlob(digest)
+	assert.Nil(t, err)
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello bloblo", string(content))
+	assert.Equal(t, meta, gotMeta)
+}
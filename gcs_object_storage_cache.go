@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSObjectStorageCache caches blobs as objects in a Google Cloud Storage
+// bucket, for operators running bloblo outside of AWS.
+type GCSObjectStorageCache struct {
+	bucketName     string
+	client         *storage.Client
+	signAccessID   string
+	signPrivateKey []byte
+	presignExpires time.Duration
+}
+
+// NewGCSObjectStorageCache builds a GCSObjectStorageCache. signAccessID and
+// signPrivateKey come from a service account key and are only used to sign
+// the presigned URLs handed out on cache hits - everything else goes
+// through client's own credentials.
+func NewGCSObjectStorageCache(client *storage.Client, bucketName string, signAccessID string, signPrivateKey []byte, presignExpires time.Duration) *GCSObjectStorageCache {
+	return &GCSObjectStorageCache{
+		bucketName:     bucketName,
+		client:         client,
+		signAccessID:   signAccessID,
+		signPrivateKey: signPrivateKey,
+		presignExpires: presignExpires,
+	}
+}
+
+func (gcsCache *GCSObjectStorageCache) object(blobDigest string) *storage.ObjectHandle {
+	return gcsCache.client.Bucket(gcsCache.bucketName).Object(blobDigest)
+}
+
+func (gcsCache *GCSObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	return gcsCache.client.Bucket(gcsCache.bucketName).SignedURL(blobDigest, &storage.SignedURLOptions{
+		GoogleAccessID: gcsCache.signAccessID,
+		PrivateKey:     gcsCache.signPrivateKey,
+		Method:         "GET",
+		Expires:        time.Now().Add(gcsCache.presignExpires),
+	})
+}
+
+func (gcsCache *GCSObjectStorageCache) isBlobInCache(blobDigest string) (bool, error) {
+	_, err := gcsCache.object(blobDigest).Attrs(context.TODO())
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// uploadBlob ignores tags - GCS doesn't have an equivalent to S3 object
+// tagging, so there's nothing to set them on.
+func (gcsCache *GCSObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	w := gcsCache.object(blobDigest).NewWriter(context.TODO())
+	w.Metadata = meta
+
+	if _, err := io.Copy(w, body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (gcsCache *GCSObjectStorageCache) abortBlob(blobDigest string) error {
+	err := gcsCache.object(blobDigest).Delete(context.TODO())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (gcsCache *GCSObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	obj := gcsCache.object(blobDigest)
+
+	attrs, err := obj.Attrs(context.TODO())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := obj.NewReader(context.TODO())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, attrs.Metadata, nil
+}
+
+// Ping confirms the configured bucket exists and is reachable with the
+// client's credentials.
+func (gcsCache *GCSObjectStorageCache) Ping(ctx context.Context) error {
+	_, err := gcsCache.client.Bucket(gcsCache.bucketName).Attrs(ctx)
+	return err
+}
+
+// Make sure GCSObjectStorageCache implements the ObjectStorageCache interface
+var _ ObjectStorageCache = (*GCSObjectStorageCache)(nil)
@@ -2,20 +2,25 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-)
-
-const (
-	presignExpirationMinutes = 5
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
 )
 
 var (
@@ -23,11 +28,51 @@ var (
 	listenAddress string
 	s3BucketName  string
 
-	s3Cache *S3ObjectStorageCache
+	cacheBackend             string
+	presignExpirationMinutes int
+	fsRoot                   string
+
+	// s3Endpoint, when set, points the S3 backend at a non-AWS,
+	// S3-compatible endpoint such as MinIO, Ceph or Wasabi, instead of
+	// real AWS S3.
+	s3Endpoint       string
+	s3Region         string
+	s3ForcePathStyle bool
+	s3Prefix         string
+	s3KeyLayoutName  string
+
+	// s3AccessKeyID, s3SecretAccessKey and s3SessionToken pin bloblo to a
+	// static set of credentials. Left empty, s3AwsConfig falls back to the
+	// AWS SDK's default provider chain instead.
+	s3AccessKeyID     string
+	s3SecretAccessKey string
+	s3SessionToken    string
+
+	// s3TaggingEnabled gates whether uploadBlob's bloblo-* tags actually
+	// get sent to S3 - see S3Config.DisableTagging.
+	s3TaggingEnabled bool
+
+	gcsBucketName      string
+	gcsCredentialsFile string
+
+	azureContainerName    string
+	azureConnectionString string
+
+	cacheabilityRulesPath string
+
+	metricsAddr string
+
+	auditBackend  string
+	auditFilePath string
+	auditMaxBytes int64
+	syslogAddr    string
+	fluentHost    string
+	fluentPort    string
+	fluentTag     string
 
-	upstreamUrl   *url.URL
-	preserveHost  bool
-	useLocalStack bool
+	upstreamUrl  *url.URL
+	preserveHost bool
+	routes       []RouteConfig
 )
 
 func initLogger() {
@@ -58,103 +103,523 @@ func initLogger() {
 	logger = zap.New(core)
 }
 
-func readConfigFromEnvs() {
-	listenAddress = os.Getenv("BLOBLO_LISTEN_ADDR")
-	if listenAddress == "" {
-		listenAddress = ":7777"
+// applyConfig fans cfg out into the package-level vars the rest of main.go
+// (and the init*Cache functions) read. It's called once at startup and
+// again on every config reload, so it must be safe to call repeatedly - it
+// just overwrites, it never appends or accumulates. It validates cfg before
+// changing any package-level state, so a bad reload leaves everything
+// exactly as it was (reloadConfig relies on this to "keep the previous
+// one" on error instead of leaving bloblo half-reconfigured).
+func applyConfig(cfg *Config) error {
+	parsedUpstreamUrl, err := url.Parse(cfg.UpstreamURL)
+	if err != nil {
+		return fmt.Errorf("parsing upstream url %q: %w", cfg.UpstreamURL, err)
 	}
 
-	s3BucketName = os.Getenv("BLOBLO_S3_BUCKET_NAME")
-	if s3BucketName == "" {
-		s3BucketName = "sample-bucket"
-	}
+	listenAddress = cfg.ListenAddr
+	preserveHost = cfg.PreserveHost
+	upstreamUrl = parsedUpstreamUrl
+	routes = cfg.Routes
+
+	cacheBackend = cfg.CacheBackend
+	presignExpirationMinutes = cfg.PresignExpirationMinutes
+
+	s3BucketName = cfg.S3.BucketName
+	// s3Endpoint is how the s3 (and minio) backends point at a non-AWS,
+	// S3-compatible endpoint - it replaces the old BLOBLO_USE_LOCALSTACK
+	// special case with something that also works for MinIO, Ceph and
+	// Wasabi in production.
+	s3Endpoint = cfg.S3.Endpoint
+	s3Region = cfg.S3.Region
+	s3ForcePathStyle = cfg.S3.ForcePathStyle
+	s3Prefix = cfg.S3.Prefix
+	s3KeyLayoutName = cfg.S3.KeyLayout
+	s3AccessKeyID = cfg.S3.AccessKeyID
+	s3SecretAccessKey = cfg.S3.SecretAccessKey
+	s3SessionToken = cfg.S3.SessionToken
+	s3TaggingEnabled = !cfg.S3.DisableTagging
+
+	fsRoot = cfg.FS.Root
+
+	gcsBucketName = cfg.GCS.BucketName
+	gcsCredentialsFile = cfg.GCS.CredentialsFile
+
+	azureContainerName = cfg.Azure.ContainerName
+	azureConnectionString = cfg.Azure.ConnectionString
+
+	// cacheabilityRulesPath is optional - with it unset bloblo falls back
+	// to caching every blob and manifest request, as it always has.
+	cacheabilityRulesPath = cfg.CacheabilityRulesPath
+
+	metricsAddr = cfg.MetricsAddr
+
+	auditBackend = cfg.Audit.Backend
+	auditFilePath = cfg.Audit.FilePath
+	auditMaxBytes = cfg.Audit.MaxBytes
+	syslogAddr = cfg.Audit.SyslogAddr
+	fluentHost = cfg.Audit.FluentHost
+	fluentPort = cfg.Audit.FluentPort
+	fluentTag = cfg.Audit.FluentTag
 
-	upstreamRawUrl := os.Getenv("BLOBLO_UPSTREAM_URL")
-	if upstreamRawUrl == "" {
-		upstreamRawUrl = "http://localhost:7000"
+	return nil
+}
+
+// defaultAuditMaxBytes bounds the file audit sink before it rotates.
+const defaultAuditMaxBytes = 100 * 1024 * 1024
+
+// initAuditSink builds the configured AuditSink, wrapped in the
+// non-blocking buffer every sink goes through, or a noop when
+// BLOBLO_AUDIT is unset.
+func initAuditSink() AuditSink {
+	var sink AuditSink
+
+	switch auditBackend {
+	case "":
+		return noopAuditSink{}
+	case "stdout":
+		sink = newJSONLinesAuditSink(os.Stdout)
+	case "file":
+		writer, err := newRotatingFileWriter(auditFilePath, auditMaxBytes)
+		if err != nil {
+			logger.Fatal("Failed to open the audit log file", zap.String("path", auditFilePath), zap.String("error", err.Error()))
+		}
+		sink = newJSONLinesAuditSink(writer)
+	case "syslog":
+		rfcSink, err := newRFC5424AuditSink(syslogAddr)
+		if err != nil {
+			logger.Fatal("Failed to connect to syslog", zap.String("addr", syslogAddr), zap.String("error", err.Error()))
+		}
+		sink = rfcSink
+	case "fluent":
+		sink = newFluentAuditSink(net.JoinHostPort(fluentHost, fluentPort), fluentTag, logger)
+	default:
+		logger.Fatal("Unknown audit backend", zap.String("backend", auditBackend))
+		return nil
 	}
 
-	preserveHost = os.Getenv("BLOBLO_PRESERVE_HOST") == "true"
+	return newBufferedAuditSink(sink, defaultAuditBufferSize, logger)
+}
+
+// initCacheabilityPolicy returns the configured CacheabilityPolicy: the
+// rules file at cacheabilityRulesPath if one was set, or the built-in
+// cache-everything default otherwise.
+func initCacheabilityPolicy() CacheabilityPolicy {
+	if cacheabilityRulesPath == "" {
+		return defaultCacheabilityPolicy{}
+	}
 
-	var err error
-	upstreamUrl, err = url.Parse(upstreamRawUrl)
+	policy, err := NewRulePolicy(cacheabilityRulesPath, defaultCacheabilityPolicy{}, logger)
 	if err != nil {
-		logger.Fatal("Can't parse the upstream url", zap.String("error", err.Error()))
+		logger.Fatal("Failed to load cacheability rules", zap.String("path", cacheabilityRulesPath), zap.String("error", err.Error()))
 	}
+	return policy
+}
 
-	useLocalStack = os.Getenv("BLOBLO_USE_LOCALSTACK") == "true"
+// s3AwsConfig builds the AWS connection config shared by the s3 and minio
+// backends. Credentials are left to the SDK's own default provider chain -
+// env vars, a shared credentials/config file, EKS IRSA's web identity
+// token, ECS task role, then EC2 instance profile, in that order, each
+// wrapped in the SDK's own refreshing credentials cache so a long-running
+// bloblo doesn't die when a temporary token expires - unless s3AccessKeyID
+// pins bloblo to a static key instead (BLOBLO_S3_ACCESS_KEY_ID and
+// friends), which is only meant for the rare backend that genuinely has
+// no provider in that chain to use.
+//
+// s3Endpoint is handled separately, per-client, in buildS3CacheForBucket:
+// left unset, the SDK already resolves AWS_ENDPOINT_URL and
+// AWS_ENDPOINT_URL_S3 on its own, so only setting it here would just get
+// in the way of that.
+func s3AwsConfig() (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+
+	if s3Endpoint != "" {
+		opts = append(opts, config.WithRegion(s3Region))
+	}
+	if s3AccessKeyID != "" {
+		provider := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(s3AccessKeyID, s3SecretAccessKey, s3SessionToken))
+		opts = append(opts, config.WithCredentialsProvider(provider))
+	}
+
+	return config.LoadDefaultConfig(context.TODO(), opts...)
 }
 
-func getLocalStackAwsConfig() (aws.Config, error) {
-	localStackResolver := aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
-		localstackUrl := "http://localhost:4566"
+func buildS3Cache() (*S3ObjectStorageCache, error) {
+	return buildS3CacheForBucket(s3BucketName)
+}
 
-		return aws.Endpoint{
-			PartitionID:   "aws",
-			URL:           localstackUrl,
-			SigningRegion: "us-east-1",
-		}, nil
-	})
-	return config.LoadDefaultConfig(context.TODO(),
-		config.WithEndpointResolver(localStackResolver))
+// buildS3KeyLayout turns the configured BLOBLO_S3_KEY_LAYOUT name into an
+// s3KeyLayout, applying s3Prefix either way.
+func buildS3KeyLayout() (s3KeyLayout, error) {
+	switch s3KeyLayoutName {
+	case "", "flat":
+		return flatS3KeyLayout(s3Prefix), nil
+	case "fanout":
+		return fanoutS3KeyLayout(s3Prefix), nil
+	default:
+		return nil, fmt.Errorf("unknown s3 key layout %q", s3KeyLayoutName)
+	}
 }
 
-func initS3Cache() {
-	var awsConfig aws.Config
-	var err error
-	if useLocalStack {
-		awsConfig, err = getLocalStackAwsConfig()
-	} else {
-		awsConfig, err = config.LoadDefaultConfig(context.TODO())
+// buildS3CacheForBucket builds an S3ObjectStorageCache against bucket,
+// reusing the same connection configuration (endpoint, region, path
+// style, prefix, key layout) as the default s3/minio backend. It's split
+// out of buildS3Cache so a route with its own S3BucketName can get a
+// dedicated cache without duplicating the AWS client setup.
+func buildS3CacheForBucket(bucket string) (*S3ObjectStorageCache, error) {
+	awsConfig, err := s3AwsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS connection configuration: %w", err)
 	}
+
+	keyLayout, err := buildS3KeyLayout()
 	if err != nil {
-		logger.Error("Error loading AWS connection configuration", zap.String("error", err.Error()))
-		return
+		return nil, err
 	}
 
 	s3Client := s3.NewFromConfig(awsConfig, func(opts *s3.Options) {
-		opts.UsePathStyle = true
+		opts.UsePathStyle = s3ForcePathStyle
+		// Scoped to the S3 client options rather than the shared aws.Config
+		// so the override only ever applies to S3 requests, not to any
+		// other AWS service bloblo might one day talk to (STS, say, for
+		// assume-role) from the same connection config.
+		if s3Endpoint != "" {
+			opts.BaseEndpoint = aws.String(s3Endpoint)
+		}
 	})
-	_, err = s3Client.GetBucketLocation(context.TODO(), &s3.GetBucketLocationInput{Bucket: &s3BucketName})
+
+	s3PresignClient := s3.NewPresignClient(s3Client)
+
+	cache := NewS3ObjectStorageCache(s3Client, s3PresignClient, bucket, presignExpirationMinutes, keyLayout, s3TaggingEnabled)
+
+	if err := cache.Ping(context.TODO()); err != nil {
+		return nil, fmt.Errorf("the object storage configuration seems to be invalid: %w", err)
+	}
+	return cache, nil
+}
+
+func buildFsCache() (*FilesystemObjectStorageCache, error) {
+	cache, err := NewFilesystemObjectStorageCache(fsRoot)
 	if err != nil {
-		logger.Error("The AWS configuration seems to be invalid", zap.String("error", err.Error()))
-		logger.Fatal(err.Error())
+		return nil, fmt.Errorf("initializing the filesystem cache at %s: %w", fsRoot, err)
 	}
+	return cache, nil
+}
 
-	s3PresignClient := s3.NewPresignClient(s3Client)
+func buildGcsCache() (*GCSObjectStorageCache, error) {
+	ctx := context.TODO()
+
+	var opts []option.ClientOption
+	if gcsCredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(gcsCredentialsFile))
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating the GCS client: %w", err)
+	}
+
+	signAccessID, signPrivateKey, err := gcsSigningCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("loading GCS signing credentials from %s: %w", gcsCredentialsFile, err)
+	}
+
+	cache := NewGCSObjectStorageCache(client, gcsBucketName, signAccessID, signPrivateKey, time.Duration(presignExpirationMinutes)*time.Minute)
+
+	if err := cache.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("the GCS configuration seems to be invalid: %w", err)
+	}
+	return cache, nil
+}
+
+// gcsSigningCredentials pulls the service account email and private key out
+// of the credentials file, since SignedURL needs them directly and can't
+// just reuse the client's own application-default credentials.
+func gcsSigningCredentials() (string, []byte, error) {
+	keyBytes, err := os.ReadFile(gcsCredentialsFile)
+	if err != nil {
+		return "", nil, err
+	}
 
-	s3Cache = NewS3ObjectStorageCache(s3Client, s3PresignClient, s3BucketName, presignExpirationMinutes)
+	jwtConfig, err := google.JWTConfigFromJSON(keyBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return jwtConfig.Email, jwtConfig.PrivateKey, nil
+}
+
+func buildAzureCache() (*AzureObjectStorageCache, error) {
+	client, err := azblob.NewClientFromConnectionString(azureConnectionString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating the Azure Blob Storage client: %w", err)
+	}
+
+	cache := NewAzureObjectStorageCache(client, azureContainerName, time.Duration(presignExpirationMinutes)*time.Minute)
+
+	if err := cache.Ping(context.TODO()); err != nil {
+		return nil, fmt.Errorf("the Azure Blob Storage configuration seems to be invalid: %w", err)
+	}
+	return cache, nil
+}
+
+// buildCache initializes the configured cache backend and returns it as an
+// ObjectStorageCache, so the rest of main doesn't need to know which one is
+// active. "minio" is just the s3 backend pointed at a non-AWS endpoint via
+// BLOBLO_S3_ENDPOINT, so it shares buildS3Cache rather than needing its own
+// client type. It's also what a config reload calls to rebuild the cache
+// after cfg changes, so unlike the old initCache it reports failures
+// instead of exiting the process.
+func buildCache() (ObjectStorageCache, error) {
+	switch cacheBackend {
+	case "fs":
+		return buildFsCache()
+	case "s3", "minio":
+		return buildS3Cache()
+	case "gcs":
+		return buildGcsCache()
+	case "azure":
+		return buildAzureCache()
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cacheBackend)
+	}
+}
+
+// buildRoutes turns the configured RouteConfig entries into UpstreamRoutes,
+// building each route's own dedicated S3ObjectStorageCache when it names
+// one. A route with no S3BucketName shares the default cache, just
+// namespaced by its Name.
+func buildRoutes() ([]UpstreamRoute, error) {
+	built := make([]UpstreamRoute, 0, len(routes))
+	for _, routeCfg := range routes {
+		parsedUpstreamUrl, err := url.Parse(routeCfg.UpstreamURL)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: parsing upstream url: %w", routeCfg.Name, err)
+		}
+
+		route := UpstreamRoute{
+			Name:         routeCfg.Name,
+			Prefix:       routeCfg.Prefix,
+			UpstreamURL:  parsedUpstreamUrl,
+			PreserveHost: routeCfg.PreserveHost,
+		}
+
+		if routeCfg.S3BucketName != "" {
+			if cacheBackend != "s3" && cacheBackend != "minio" {
+				return nil, fmt.Errorf("route %q sets s3_bucket_name but the cache backend is %q, not s3", routeCfg.Name, cacheBackend)
+			}
+			cache, err := buildS3CacheForBucket(routeCfg.S3BucketName)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", routeCfg.Name, err)
+			}
+			route.Cache = cache
+		}
+
+		built = append(built, route)
+	}
+	return built, nil
+}
+
+// buildUpstreamRouter assembles the UpstreamRouter main() and reloadConfig
+// hand BlobloProxy: the configured Routes, falling back to the default
+// upstream (upstreamUrl/preserveHost) for everything else.
+func buildUpstreamRouter() (*UpstreamRouter, error) {
+	upstreamRoutes, err := buildRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultRoute := UpstreamRoute{UpstreamURL: upstreamUrl, PreserveHost: preserveHost}
+	return NewUpstreamRouter(upstreamRoutes, defaultRoute, logger), nil
+}
+
+// reloadConfig re-reads BLOBLO_CONFIG (plus env overrides) and atomically
+// swaps the settings a reload is actually safe to change without dropping
+// connections: the upstream URL and the cache backend (which also covers
+// its credentials and presign expiration, since those are baked in at
+// construction). Everything else - listen address, audit backend, the
+// cacheability rules path - needs a restart, same as before this existed.
+func reloadConfig(blobloProxy *BlobloProxy, dynamicCache *DynamicObjectStorageCache) {
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("Failed to reload config, keeping the previous one", zap.String("error", err.Error()))
+		return
+	}
+	if err := applyConfig(cfg); err != nil {
+		logger.Error("Failed to apply reloaded config, keeping the previous one", zap.String("error", err.Error()))
+		return
+	}
+
+	router, err := buildUpstreamRouter()
+	if err != nil {
+		logger.Error("Failed to rebuild the upstream router, keeping the previous one", zap.String("error", err.Error()))
+		return
+	}
+	blobloProxy.SetRouter(router)
+
+	newCache, err := buildCache()
+	if err != nil {
+		logger.Error("Failed to rebuild the cache backend, keeping the previous one", zap.String("error", err.Error()))
+		return
+	}
+	dynamicCache.Store(newCache)
+
+	logger.Info("Reloaded config", zap.String("upstream", upstreamUrl.String()), zap.String("cache_backend", cacheBackend), zap.Int("routes", len(routes)))
+}
+
+// watchConfigForReload watches BLOBLO_CONFIG with fsnotify and reloads on
+// every change. It watches the containing directory rather than the file
+// itself, since an atomic replace (the symlink swap a Kubernetes ConfigMap
+// mount does, or what many editors do on save) removes and recreates the
+// directory entry rather than writing through the existing one, which
+// would otherwise drop a watch placed directly on the file.
+func watchConfigForReload(blobloProxy *BlobloProxy, dynamicCache *DynamicObjectStorageCache) {
+	path := os.Getenv("BLOBLO_CONFIG")
+	if path == "" {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Failed to start the config file watcher, config changes will require a restart", zap.String("error", err.Error()))
+		return
+	}
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		logger.Error("Failed to watch the config directory, config changes will require a restart", zap.String("dir", dir), zap.String("error", err.Error()))
+		watcher.Close()
+		return
+	}
+
+	// A ConfigMap update never names path itself in an event - it swaps the
+	// ..data symlink path resolves through - so a change in where path
+	// resolves to counts as a change to the file too.
+	resolvedPath, _ := filepath.EvalSymlinks(path)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				newResolvedPath, _ := filepath.EvalSymlinks(path)
+				symlinkSwapped := newResolvedPath != "" && newResolvedPath != resolvedPath
+				resolvedPath = newResolvedPath
+				if !symlinkSwapped {
+					if filepath.Clean(event.Name) != filepath.Clean(path) {
+						continue
+					}
+					if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+						continue
+					}
+				}
+				reloadConfig(blobloProxy, dynamicCache)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Config file watcher error", zap.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// runValidateS3Layout is the `bloblo validate-s3-layout` command: it lists
+// the configured S3 bucket and reports any object whose key doesn't match
+// the currently configured BLOBLO_S3_PREFIX/BLOBLO_S3_KEY_LAYOUT, so an
+// operator can check a bucket is safe to switch layouts on before
+// reconfiguring bloblo to use the new one for real.
+func runValidateS3Layout() error {
+	if cacheBackend != "s3" && cacheBackend != "minio" {
+		return fmt.Errorf("validate-s3-layout only applies to the s3/minio cache backend, not %q", cacheBackend)
+	}
+
+	cache, err := buildS3Cache()
+	if err != nil {
+		return err
+	}
+
+	// Routes with no S3BucketName of their own share this bucket, just
+	// namespaced by their Name (see UpstreamRoute.cacheKey) - those
+	// namespaces are legitimate, not a leftover layout to flag.
+	var routeNames []string
+	for _, route := range routes {
+		if route.S3BucketName == "" {
+			routeNames = append(routeNames, route.Name)
+		}
+	}
+
+	mismatched, err := cache.ValidateKeyLayout(context.TODO(), routeNames)
+	if err != nil {
+		return fmt.Errorf("listing bucket %s: %w", s3BucketName, err)
+	}
+
+	if len(mismatched) == 0 {
+		logger.Info("Every object matches the configured layout", zap.String("bucket", s3BucketName))
+		return nil
+	}
+
+	for _, key := range mismatched {
+		logger.Warn("Object does not match the configured layout", zap.String("key", key))
+	}
+	return fmt.Errorf("%d objects in %s don't match the configured layout", len(mismatched), s3BucketName)
 }
 
 func main() {
 	initLogger()
 	defer logger.Sync()
 
-	readConfigFromEnvs()
-	initS3Cache()
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Fatal("Failed to load config", zap.String("error", err.Error()))
+	}
+	if err := applyConfig(cfg); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "validate-s3-layout" {
+		if err := runValidateS3Layout(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	}
+
+	objectCache, err := buildCache()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	dynamicCache := NewDynamicObjectStorageCache(objectCache)
+
+	metricsServer := newMetricsServer(dynamicCache)
+	metricsServer.Addr = metricsAddr
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics server stopped", zap.String("error", err.Error()))
+		}
+	}()
+	logger.Sugar().Infof("Serving /metrics, /healthz and /readyz on %s", metricsAddr)
 
 	logger.Sugar().Infof("Hello, World! I will use %s as my upstream and listen on %s", upstreamUrl, listenAddress)
-	logger.Sugar().Infof("I will keep my blobs in the bucket named %s", s3BucketName)
+	logger.Sugar().Infof("I will cache blobs using the %s backend", cacheBackend)
+	if len(routes) > 0 {
+		logger.Sugar().Infof("I will also route %d repositories to their own upstreams", len(routes))
+	}
 	logger.Info("Please keep your fingers crossed ;)")
 
-	fallbackReverseProxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = upstreamUrl.Scheme
-			req.URL.Host = upstreamUrl.Host
-			if !preserveHost {
-				req.Host = upstreamUrl.Host
-			}
-			if _, ok := req.Header["User-Agent"]; !ok {
-				// explicitly disable User-Agent so it's not set to default value
-				req.Header.Set("User-Agent", "")
-			}
-		},
-		ErrorLog: zap.NewStdLog(logger),
+	router, err := buildUpstreamRouter()
+	if err != nil {
+		logger.Fatal("Failed to build the upstream router", zap.String("error", err.Error()))
 	}
 
-	blobloProxy := NewBlobloProxy(upstreamUrl, s3Cache, fallbackReverseProxy, logger)
-	err := http.ListenAndServe(listenAddress, blobloProxy)
-	if err != nil {
+	blobloProxy := NewBlobloProxy(router, dynamicCache, logger)
+	blobloProxy.policy = initCacheabilityPolicy()
+	blobloProxy.audit = initAuditSink()
+
+	watchConfigForReload(blobloProxy, dynamicCache)
+
+	if err := http.ListenAndServe(listenAddress, blobloProxy); err != nil {
 		logger.Fatal(err.Error())
 	}
 }
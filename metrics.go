@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// requestLabels is the label set shared by bloblo's per-request metrics:
+// the object kind ("blob" or "manifest"), the repository the request
+// addressed and the algorithm of the digest involved (e.g. "sha256"). repo
+// and algo are "unknown" when a request doesn't carry enough information to
+// fill them in (a non-registry-shaped path, or a manifest still addressed
+// by tag).
+var requestLabels = []string{"kind", "repo", "algo"}
+
+var (
+	cacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_cache_hits_total",
+		Help: "Requests served from the cache, by object kind, repository and digest algorithm.",
+	}, requestLabels)
+
+	cacheMissesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_cache_misses_total",
+		Help: "Requests that missed the cache and were fetched from upstream, by object kind, repository and digest algorithm.",
+	}, requestLabels)
+
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bloblo_upstream_request_duration_seconds",
+		Help:    "Latency of requests bloblo made to the upstream registry.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "repo", "algo"})
+
+	cacheUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bloblo_cache_upload_duration_seconds",
+		Help:    "Latency of streaming a fetched object into the cache backend.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	cacheUploadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_cache_upload_bytes_total",
+		Help: "Bytes uploaded into the cache backend, by object kind.",
+	}, []string{"kind"})
+
+	bytesTransferredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_bytes_transferred_total",
+		Help: "Bytes sent to clients, by object kind, repository, digest algorithm and source (\"cache\" or \"upstream\").",
+	}, []string{"kind", "repo", "algo", "source"})
+
+	upstreamFallbackTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_upstream_fallback_total",
+		Help: "Requests proxied straight to upstream instead of being served from the cache, by repository, digest algorithm and reason.",
+	}, []string{"repo", "algo", "reason"})
+
+	digestMismatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bloblo_digest_mismatches_total",
+		Help: "Blobs rejected because their content didn't match the requested digest.",
+	})
+
+	singleflightDedupedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bloblo_singleflight_deduped_total",
+		Help: "Requests that rode along an in-flight upstream fetch instead of starting their own.",
+	})
+
+	presignRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloblo_presign_requests_total",
+		Help: "Presigned URL generations, by repository, digest algorithm and outcome (\"ok\" or \"error\").",
+	}, []string{"repo", "algo", "outcome"})
+
+	presignDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bloblo_presign_duration_seconds",
+		Help:    "Latency of generating a presigned URL for a cached object.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"repo", "algo"})
+)
+
+// newMetricsServer builds the HTTP server bloblo exposes /metrics,
+// /healthz and /readyz on. It's deliberately separate from the main proxy
+// listener so scraping and liveness checks never contend with registry
+// traffic.
+func newMetricsServer(cache ObjectStorageCache) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := cache.Ping(req.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return &http.Server{Handler: mux}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pingableObjectStorageCache struct {
+	testObjectStorageCache
+	pingErr error
+}
+
+func (cache *pingableObjectStorageCache) Ping(ctx context.Context) error {
+	return cache.pingErr
+}
+
+func TestHealthzAlwaysReportsOk(t *testing.T) {
+	server := newMetricsServer(&pingableObjectStorageCache{})
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+}
+
+func TestReadyzReflectsCachePing(t *testing.T) {
+	server := newMetricsServer(&pingableObjectStorageCache{pingErr: errors.New("bucket unreachable")})
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, 503, rec.Code)
+	assert.Contains(t, rec.Body.String(), "bucket unreachable")
+}
+
+func TestReadyzOkWhenCacheIsReachable(t *testing.T) {
+	server := newMetricsServer(&pingableObjectStorageCache{})
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,20 +19,56 @@ import (
 type ObjectStorageCache interface {
 	getPresignedUrl(blobDigest string) (string, error)
 	isBlobInCache(blobDigest string) (bool, error)
-	uploadBlob(blobDigest string, body io.Reader) error
+	// uploadBlob uploads body under blobDigest with meta as backend-level
+	// object metadata and tags as backend-level object tags. tags is only
+	// honored by backends that actually support tagging (currently just
+	// S3, and only with tagging enabled there - see
+	// S3ObjectStorageCache.taggingEnabled); everyone else ignores it.
+	uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error
+	abortBlob(blobDigest string) error
+	// getBlob returns the cached body and metadata for a digest, for
+	// callers (like manifest serving) that need the bytes inline rather
+	// than a presigned redirect.
+	getBlob(blobDigest string) (io.ReadCloser, map[string]string, error)
+	// Ping does a cheap check that the backend is reachable and usable,
+	// for startup validation and the /readyz endpoint.
+	Ping(ctx context.Context) error
+}
+
+// s3CacheClient is the subset of the S3 API that S3ObjectStorageCache needs
+// outside of uploading, kept narrow so it's easy to fake in tests.
+type s3CacheClient interface {
+	s3.HeadObjectAPIClient
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 type S3ObjectStorageCache struct {
 	s3BucketName             string
-	s3Client                 s3.HeadObjectAPIClient
+	s3Client                 s3CacheClient
 	s3PresignClient          S3PresignGetObjectAPIClient
 	s3Uploader               *manager.Uploader
 	presignExpirationMinutes int
+	// keyLayout maps a blobDigest to the object key it's actually stored
+	// under - see s3_key_layout.go.
+	keyLayout s3KeyLayout
+	// taggingEnabled gates whether uploadBlob's tags are actually sent to
+	// S3 as object tags. It exists because PutObjectTagging is a separate
+	// IAM permission (s3:PutObjectTagging) some operators don't want to
+	// grant, or don't need - lifecycle rules and cost-allocation reports
+	// are opt-in uses of the tags, not something bloblo depends on.
+	taggingEnabled bool
 }
 
 type S3ClientInterface interface {
 	s3.HeadObjectAPIClient
 	manager.UploadAPIClient
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 type S3PresignGetObjectAPIClient interface {
@@ -40,22 +78,31 @@ type S3PresignGetObjectAPIClient interface {
 		optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
 }
 
-func NewS3ObjectStorageCache(s3Client S3ClientInterface, s3PresignClient S3PresignGetObjectAPIClient, bucketName string, presignExpirationMinutes int) *S3ObjectStorageCache {
+// NewS3ObjectStorageCache builds an S3ObjectStorageCache. A nil layout
+// means the original flat, unprefixed behaviour.
+func NewS3ObjectStorageCache(s3Client S3ClientInterface, s3PresignClient S3PresignGetObjectAPIClient, bucketName string, presignExpirationMinutes int, layout s3KeyLayout, taggingEnabled bool) *S3ObjectStorageCache {
+	if layout == nil {
+		layout = flatS3KeyLayout("")
+	}
+
 	return &S3ObjectStorageCache{
 		s3BucketName:             bucketName,
 		s3Client:                 s3Client,
 		s3PresignClient:          s3PresignClient,
 		s3Uploader:               manager.NewUploader(s3Client),
 		presignExpirationMinutes: presignExpirationMinutes,
+		keyLayout:                layout,
+		taggingEnabled:           taggingEnabled,
 	}
 }
 
 func (s3Cache *S3ObjectStorageCache) getPresignedUrl(blobDigest string) (string, error) {
+	key := s3Cache.keyLayout(blobDigest)
 	urlStr, err := s3Cache.s3PresignClient.PresignGetObject(
 		context.TODO(),
 		&s3.GetObjectInput{
 			Bucket: aws.String(s3Cache.s3BucketName),
-			Key:    aws.String(blobDigest),
+			Key:    aws.String(key),
 		}, s3.WithPresignExpires(time.Duration(s3Cache.presignExpirationMinutes)*time.Minute))
 
 	if err != nil {
@@ -66,32 +113,192 @@ func (s3Cache *S3ObjectStorageCache) getPresignedUrl(blobDigest string) (string,
 }
 
 func (s3Cache *S3ObjectStorageCache) isBlobInCache(blobDigest string) (isInCache bool, err error) {
-	_, err = s3Cache.s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: &s3Cache.s3BucketName, Key: &blobDigest})
+	key := s3Cache.keyLayout(blobDigest)
+	headOutput, err := s3Cache.s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket:       &s3Cache.s3BucketName,
+		Key:          &key,
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
 
 	if err != nil {
-		isInCache = false
-
 		var ae smithy.APIError
 		if errors.As(err, &ae) && ae.ErrorCode() == "NotFound" {
-			err = nil
+			return false, nil
 		}
-	} else {
-		isInCache = true
+		return false, err
+	}
+
+	if !s3Cache.storedChecksumMatches(blobDigest, headOutput) {
+		// The object that's already there doesn't match what we were asked
+		// for - treat it as a miss so the caller re-fetches from upstream
+		// instead of redirecting clients to a corrupt blob.
+		return false, nil
 	}
-	return
+
+	return true, nil
 }
 
-func (s3Cache *S3ObjectStorageCache) uploadBlob(blobDigest string, body io.Reader) error {
-	_, err := s3Cache.s3Uploader.Upload(
-		context.TODO(),
-		&s3.PutObjectInput{
+// storedChecksumMatches compares the SHA256 checksum S3 recorded for an
+// object (we ask for it with ChecksumAlgorithmSha256 on upload) against the
+// digest the client requested. Non-SHA256 digests, or objects uploaded
+// without a checksum, are assumed to match since we have nothing to compare.
+// Objects uploaded as multipart (composite checksums, "<base64>-<partcount>")
+// are also assumed to match: S3 only ever computes a composite checksum over
+// the parts for those, never one over the whole object, so it can never
+// equal the client's whole-object digest even for a perfectly intact blob -
+// we already verified the digest ourselves on upload (fetchAndCacheBlob), so
+// there's nothing more trustworthy to compare against here.
+func (s3Cache *S3ObjectStorageCache) storedChecksumMatches(blobDigest string, headOutput *s3.HeadObjectOutput) bool {
+	algo, hexDigest, err := splitDigest(blobDigest)
+	if err != nil || algo != "sha256" || headOutput.ChecksumSHA256 == nil {
+		return true
+	}
+
+	stored := *headOutput.ChecksumSHA256
+	if strings.Contains(stored, "-") {
+		return true
+	}
+
+	wantChecksum, err := hexDigestToBase64(hexDigest)
+	if err != nil {
+		return true
+	}
+
+	return stored == wantChecksum
+}
+
+func (s3Cache *S3ObjectStorageCache) uploadBlob(blobDigest string, body io.Reader, meta map[string]string, tags map[string]string) error {
+	key := s3Cache.keyLayout(blobDigest)
+	input := &s3.PutObjectInput{
+		Bucket:            &s3Cache.s3BucketName,
+		Key:               &key,
+		Body:              body,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		Metadata:          meta,
+	}
+
+	if s3Cache.taggingEnabled && len(tags) > 0 {
+		tagging := encodeS3Tagging(tags)
+		input.Tagging = &tagging
+	}
+
+	// The upload manager forwards PutObjectInput's fields - Tagging
+	// included - onto CreateMultipartUploadInput too when body is large
+	// enough to need multipart, so this is the one PutObject-shaped call
+	// site tags need to be set at for both paths.
+	_, err := s3Cache.s3Uploader.Upload(context.TODO(), input)
+
+	return err
+}
+
+// encodeS3Tagging turns a tag set into the URL-query-encoded string S3's
+// Tagging field expects (e.g. "bloblo-repo=myorg%2Fubuntu&bloblo-upstream=registry.example.com").
+func encodeS3Tagging(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// getBlob fetches a cached object's body along with the metadata it was
+// uploaded with (e.g. the Content-Type of a cached manifest).
+func (s3Cache *S3ObjectStorageCache) getBlob(blobDigest string) (io.ReadCloser, map[string]string, error) {
+	key := s3Cache.keyLayout(blobDigest)
+	output, err := s3Cache.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &s3Cache.s3BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return output.Body, output.Metadata, nil
+}
+
+// abortBlob removes a blob that turned out to be corrupt. The SDK's upload
+// manager already aborts the underlying multipart upload itself when a part
+// fails mid-flight, so by the time we get here - a digest mismatch detected
+// only after the object was fully written - there's nothing left to abort
+// but the finished object.
+func (s3Cache *S3ObjectStorageCache) abortBlob(blobDigest string) error {
+	key := s3Cache.keyLayout(blobDigest)
+	_, err := s3Cache.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &s3Cache.s3BucketName,
+		Key:    &key,
+	})
+	return err
+}
+
+// Ping does a HeadBucket call, which confirms both that the bucket exists
+// and that the configured credentials can reach it, without the cost of
+// actually listing or fetching anything.
+func (s3Cache *S3ObjectStorageCache) Ping(ctx context.Context) error {
+	_, err := s3Cache.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &s3Cache.s3BucketName})
+	return err
+}
+
+// ValidateKeyLayout lists every object in the bucket and checks it sits at
+// the key this cache's configured layout would compute from its own
+// embedded digest - catching objects left over from a different layout
+// before an operator switches to a new one. routeNames are the route
+// namespaces (see UpstreamRoute.cacheKey) that share this bucket, so a key
+// legitimately stored under one of them isn't mistaken for a stale one. It
+// returns the keys that don't match.
+func (s3Cache *S3ObjectStorageCache) ValidateKeyLayout(ctx context.Context, routeNames []string) ([]string, error) {
+	var mismatched []string
+	var continuationToken *string
+
+	for {
+		output, err := s3Cache.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 			Bucket:            &s3Cache.s3BucketName,
-			Key:               &blobDigest,
-			Body:              body,
-			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			ContinuationToken: continuationToken,
 		})
+		if err != nil {
+			return nil, err
+		}
 
-	return err
+		for _, object := range output.Contents {
+			key := aws.ToString(object.Key)
+			if !s3Cache.keyMatchesLayout(key, routeNames) {
+				mismatched = append(mismatched, key)
+			}
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return mismatched, nil
+}
+
+// keyMatchesLayout reports whether key is what the configured layout would
+// produce for some blobDigest - either unnamespaced, or namespaced by one
+// of routeNames (UpstreamRoute.cacheKey namespaces a route's keys with
+// "<name>/", so the embedded digest alone isn't enough to reproduce the
+// key for those).
+func (s3Cache *S3ObjectStorageCache) keyMatchesLayout(key string, routeNames []string) bool {
+	blobDigest := key
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		blobDigest = key[idx+1:]
+	}
+
+	if s3Cache.keyLayout(blobDigest) == key {
+		return true
+	}
+
+	for _, name := range routeNames {
+		if name == "" {
+			continue
+		}
+		if s3Cache.keyLayout(name+"/"+blobDigest) == key {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Make sure S3ObjectStorageCache implements the ObjectStorageCache interface
@@ -2,23 +2,37 @@ package main
 
 import (
 	"context"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 )
 
 type s3ClientImpl struct {
-	err error
+	err     error
+	objects []types.Object
+
+	headObjectOutput   *s3.HeadObjectOutput
+	lastPutObjectInput *s3.PutObjectInput
 }
 
 func (s3Client *s3ClientImpl) HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
-	return nil, s3Client.err
+	if s3Client.err != nil {
+		return nil, s3Client.err
+	}
+	if s3Client.headObjectOutput != nil {
+		return s3Client.headObjectOutput, nil
+	}
+	return &s3.HeadObjectOutput{}, nil
 }
 
-func (s3Client *s3ClientImpl) PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-	return nil, nil
+func (s3Client *s3ClientImpl) PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	s3Client.lastPutObjectInput = input
+	return &s3.PutObjectOutput{}, nil
 }
 
 func (s3Client *s3ClientImpl) UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
@@ -37,11 +51,110 @@ func (s3Client *s3ClientImpl) AbortMultipartUpload(context.Context, *s3.AbortMul
 	return nil, nil
 }
 
+func (s3Client *s3ClientImpl) DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return nil, nil
+}
+
+func (s3Client *s3ClientImpl) GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return nil, nil
+}
+
+func (s3Client *s3ClientImpl) HeadBucket(context.Context, *s3.HeadBucketInput, ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return nil, s3Client.err
+}
+
+func (s3Client *s3ClientImpl) ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if s3Client.err != nil {
+		return nil, s3Client.err
+	}
+	return &s3.ListObjectsV2Output{Contents: s3Client.objects}, nil
+}
+
 func TestIsInCacheReturnsNilErrorForNotFoundItemsToAvoidFloodingLogs(t *testing.T) {
 	s3Client := &s3ClientImpl{err: &smithy.GenericAPIError{Code: "NotFound"}}
-	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5)
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, true)
 	isInCache, err := s3Cache.isBlobInCache("someobject")
 
 	assert.Nil(t, err)
 	assert.Equal(t, false, isInCache)
 }
+
+func TestPingReturnsTheHeadBucketError(t *testing.T) {
+	s3Client := &s3ClientImpl{err: &smithy.GenericAPIError{Code: "NoSuchBucket"}}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, true)
+
+	assert.Equal(t, s3Client.err, s3Cache.Ping(context.Background()))
+}
+
+func TestUploadBlobSetsTagsWhenTaggingIsEnabled(t *testing.T) {
+	s3Client := &s3ClientImpl{}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, true)
+
+	err := s3Cache.uploadBlob("sha256:abcd", strings.NewReader("body"), nil, map[string]string{"bloblo-repo": "myorg/myrepo"})
+	assert.Nil(t, err)
+	assert.Equal(t, "bloblo-repo=myorg%2Fmyrepo", aws.ToString(s3Client.lastPutObjectInput.Tagging))
+}
+
+func TestUploadBlobLeavesTagsUnsetWhenTaggingIsDisabled(t *testing.T) {
+	s3Client := &s3ClientImpl{}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, false)
+
+	err := s3Cache.uploadBlob("sha256:abcd", strings.NewReader("body"), nil, map[string]string{"bloblo-repo": "myorg/myrepo"})
+	assert.Nil(t, err)
+	assert.Nil(t, s3Client.lastPutObjectInput.Tagging)
+}
+
+func TestIsBlobInCacheTreatsACompositeMultipartChecksumAsAMatch(t *testing.T) {
+	// S3 only ever reports a composite ("<base64>-<partcount>") checksum for
+	// objects uploaded as multipart, never one comparable to a whole-object
+	// digest - even for an object that's perfectly intact.
+	s3Client := &s3ClientImpl{headObjectOutput: &s3.HeadObjectOutput{
+		ChecksumSHA256: aws.String("deadbeef-3"),
+	}}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, true)
+
+	isInCache, err := s3Cache.isBlobInCache("sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd")
+	assert.Nil(t, err)
+	assert.True(t, isInCache)
+}
+
+func TestIsBlobInCacheRejectsAMismatchedSinglePartChecksum(t *testing.T) {
+	s3Client := &s3ClientImpl{headObjectOutput: &s3.HeadObjectOutput{
+		ChecksumSHA256: aws.String("dGhpc2lzbm90dGhlcmlnaHRjaGVja3N1bQ=="),
+	}}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, nil, true)
+
+	isInCache, err := s3Cache.isBlobInCache("sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd")
+	assert.Nil(t, err)
+	assert.False(t, isInCache)
+}
+
+func TestValidateKeyLayoutReportsObjectsThatDontMatchTheConfiguredLayout(t *testing.T) {
+	goodKey := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	badKey := "stale/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+
+	s3Client := &s3ClientImpl{objects: []types.Object{
+		{Key: aws.String(goodKey)},
+		{Key: aws.String(badKey)},
+	}}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, flatS3KeyLayout(""), true)
+
+	mismatched, err := s3Cache.ValidateKeyLayout(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{badKey}, mismatched)
+}
+
+func TestValidateKeyLayoutAcceptsKeysNamespacedByAKnownRoute(t *testing.T) {
+	routedKey := "myorg/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	staleKey := "stale/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+
+	s3Client := &s3ClientImpl{objects: []types.Object{
+		{Key: aws.String(routedKey)},
+		{Key: aws.String(staleKey)},
+	}}
+	s3Cache := NewS3ObjectStorageCache(s3Client, nil, "bucketname", 5, flatS3KeyLayout(""), true)
+
+	mismatched, err := s3Cache.ValidateKeyLayout(context.Background(), []string{"myorg"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{staleKey}, mismatched)
+}
@@ -0,0 +1,57 @@
+package main
+
+import "strings"
+
+// s3KeyLayout maps a blobDigest (or cache key - see UpstreamRoute.cacheKey)
+// to the S3 object key S3ObjectStorageCache stores and fetches it under.
+// It's applied consistently everywhere a key reaches S3 - HEAD, the
+// presigned GET URL, and PUT - so every code path agrees on where a blob
+// actually lives.
+type s3KeyLayout func(blobDigest string) string
+
+// flatS3KeyLayout stores blobDigest directly under prefix (joined with
+// "/", prefix may be empty) - the layout bloblo has always used. An
+// operator setting BLOBLO_S3_PREFIX can share a bucket with other tools
+// without their objects colliding with bloblo's.
+func flatS3KeyLayout(prefix string) s3KeyLayout {
+	return func(blobDigest string) string {
+		return joinS3Key(prefix, blobDigest)
+	}
+}
+
+// fanoutS3KeyLayout shards blobDigest into a two-level subdirectory named
+// after the first four hex characters of its digest
+// (<prefix>/sha256/ab/cd/sha256:abcd...), spreading objects across S3
+// prefixes to avoid the request-rate hot-spots a single flat prefix runs
+// into at scale. The digest is looked up from the last "/"-separated
+// component of blobDigest, so it still works when blobDigest has already
+// been namespaced by a route (see UpstreamRoute.cacheKey) - the full,
+// namespaced value is still what's stored as the final key component, so
+// routes keep sharding independently of each other.
+func fanoutS3KeyLayout(prefix string) s3KeyLayout {
+	return func(blobDigest string) string {
+		lookupDigest := blobDigest
+		if idx := strings.LastIndex(blobDigest, "/"); idx >= 0 {
+			lookupDigest = blobDigest[idx+1:]
+		}
+
+		algo, hexDigest, err := splitDigest(lookupDigest)
+		if err != nil || len(hexDigest) < 4 {
+			// Nothing we can shard on (e.g. a malformed reference) - fall
+			// back to flat so it still resolves to a consistent key.
+			return joinS3Key(prefix, blobDigest)
+		}
+
+		return joinS3Key(prefix, algo, hexDigest[0:2], hexDigest[2:4], blobDigest)
+	}
+}
+
+func joinS3Key(parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
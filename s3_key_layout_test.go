@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatS3KeyLayoutJoinsThePrefix(t *testing.T) {
+	layout := flatS3KeyLayout("myprefix")
+	assert.Equal(t, "myprefix/sha256:abcd", layout("sha256:abcd"))
+
+	layout = flatS3KeyLayout("")
+	assert.Equal(t, "sha256:abcd", layout("sha256:abcd"))
+}
+
+func TestFanoutS3KeyLayoutShardsByDigest(t *testing.T) {
+	layout := fanoutS3KeyLayout("")
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	assert.Equal(t, "sha256/89/1b/"+digest, layout(digest))
+}
+
+func TestFanoutS3KeyLayoutAppliesThePrefix(t *testing.T) {
+	layout := fanoutS3KeyLayout("myprefix")
+	digest := "sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	assert.Equal(t, "myprefix/sha256/89/1b/"+digest, layout(digest))
+}
+
+func TestFanoutS3KeyLayoutFallsBackToFlatForUnshardableKeys(t *testing.T) {
+	layout := fanoutS3KeyLayout("myprefix")
+	assert.Equal(t, "myprefix/not-a-digest", layout("not-a-digest"))
+}
+
+func TestFanoutS3KeyLayoutShardsByTheDigestInANamespacedCacheKey(t *testing.T) {
+	layout := fanoutS3KeyLayout("")
+	cacheKey := "myorg/sha256:891b05d87f5e008949d4caf55929c31c3aab0ecbd5ae19e40e8f1421ffd612dd"
+	assert.Equal(t, "sha256/89/1b/"+cacheKey, layout(cacheKey))
+}
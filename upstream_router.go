@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+
+	"go.uber.org/zap"
+)
+
+// UpstreamRoute is one entry in an UpstreamRouter: requests whose
+// repository ("<namespace>/<name>") matches Prefix are proxied to
+// UpstreamURL instead of whichever other upstream would otherwise apply.
+// Bloblo doesn't inject any credentials of its own - the client's
+// Authorization header rides along unchanged, same as it always has - so
+// "its own auth" per upstream just falls out of each one being a distinct
+// destination the client authenticates against directly.
+type UpstreamRoute struct {
+	// Name identifies the route (e.g. "library", "myorg", "quay") and
+	// namespaces its cache keys, so two upstreams serving the same digest
+	// never collide. The default route - matched when nothing more
+	// specific does - conventionally leaves this empty, so a
+	// single-upstream deployment's cache keys are unchanged from before
+	// routing existed.
+	Name string
+
+	// Prefix is a path.Match glob tested against "<namespace>/<name>",
+	// e.g. "library/*", "myorg/*", "quay.io/*". The default route's Prefix
+	// is never tested: it applies whenever no other route matches.
+	Prefix string
+
+	UpstreamURL  *url.URL
+	PreserveHost bool
+
+	// Cache overrides BlobloProxy's default ObjectStorageCache for this
+	// route, for operators who want a dedicated bucket for one upstream.
+	// Nil means "use the default cache, just namespaced by Name". Only
+	// backends that hand out presigned URLs (s3, gcs, azure) are safe to
+	// use here for more than one route at a time - the filesystem
+	// backend's local-serving path (serveLocalBlob) always goes through
+	// BlobloProxy's default cache, not a route's override.
+	Cache ObjectStorageCache
+
+	reverseProxy *httputil.ReverseProxy
+}
+
+// cacheKey namespaces digest by this route's Name, so routes sharing a
+// cache backend never collide on the same digest.
+func (route UpstreamRoute) cacheKey(digest string) string {
+	if route.Name == "" {
+		return digest
+	}
+	return route.Name + "/" + digest
+}
+
+// cacheFor returns this route's dedicated cache if it has one, or
+// defaultCache otherwise.
+func (route UpstreamRoute) cacheFor(defaultCache ObjectStorageCache) ObjectStorageCache {
+	if route.Cache != nil {
+		return route.Cache
+	}
+	return defaultCache
+}
+
+// UpstreamRouter dispatches requests to an UpstreamRoute by repository
+// prefix, turning bloblo from a single-upstream mirror into a pull-through
+// hub for a fleet of registries.
+type UpstreamRouter struct {
+	routes       []UpstreamRoute
+	defaultRoute UpstreamRoute
+}
+
+// NewUpstreamRouter builds a router from routes (tried in order - list
+// more specific prefixes first) falling back to defaultRoute when nothing
+// matches. defaultRoute is also what non-registry-shaped requests (e.g.
+// the API version check at "/v2/") are proxied to; registry-shaped
+// requests bloblo can't serve from cache go to the route they matched.
+func NewUpstreamRouter(routes []UpstreamRoute, defaultRoute UpstreamRoute, logger *zap.Logger) *UpstreamRouter {
+	built := make([]UpstreamRoute, len(routes))
+	for i, route := range routes {
+		route.reverseProxy = newRouteReverseProxy(route, logger)
+		built[i] = route
+	}
+
+	defaultRoute.reverseProxy = newRouteReverseProxy(defaultRoute, logger)
+
+	return &UpstreamRouter{routes: built, defaultRoute: defaultRoute}
+}
+
+// Match returns the first route whose Prefix matches regPath's repository,
+// or the default route if none do.
+func (router *UpstreamRouter) Match(regPath registryPath) UpstreamRoute {
+	repo := repositoryFor(regPath)
+	for _, route := range router.routes {
+		if ok, _ := path.Match(route.Prefix, repo); ok {
+			return route
+		}
+	}
+	return router.defaultRoute
+}
+
+// Default returns the route used for requests that never resolve to a
+// repository at all.
+func (router *UpstreamRouter) Default() UpstreamRoute {
+	return router.defaultRoute
+}
+
+// repositoryFor renders a registryPath back into the "<namespace>/<name>"
+// form routes match against.
+func repositoryFor(regPath registryPath) string {
+	if regPath.Namespace == "" {
+		return regPath.Name
+	}
+	return regPath.Namespace + "/" + regPath.Name
+}
+
+// newRouteReverseProxy builds the plain reverse proxy a route falls back
+// to for anything bloblo doesn't serve from cache - the same Director
+// logic main.go used to build once for the single upstream it had.
+func newRouteReverseProxy(route UpstreamRoute, logger *zap.Logger) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = route.UpstreamURL.Scheme
+			req.URL.Host = route.UpstreamURL.Host
+			if !route.PreserveHost {
+				req.Host = route.UpstreamURL.Host
+			}
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorLog: zap.NewStdLog(logger),
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func testLogger() *zap.Logger {
+	observedZapCore, _ := observer.New(zap.InfoLevel)
+	return zap.New(observedZapCore)
+}
+
+func TestUpstreamRouterMatchesAConfiguredRoute(t *testing.T) {
+	defaultUpstream, _ := url.Parse("http://default.example.com")
+	myorgUpstream, _ := url.Parse("http://myorg.example.com")
+
+	router := NewUpstreamRouter(
+		[]UpstreamRoute{{Name: "myorg", Prefix: "myorg/*", UpstreamURL: myorgUpstream}},
+		UpstreamRoute{UpstreamURL: defaultUpstream},
+		testLogger(),
+	)
+
+	route := router.Match(registryPath{Namespace: "myorg", Name: "widget", Kind: "blobs"})
+	assert.Equal(t, "myorg", route.Name)
+	assert.Equal(t, myorgUpstream, route.UpstreamURL)
+}
+
+func TestUpstreamRouterFallsBackToTheDefaultRoute(t *testing.T) {
+	defaultUpstream, _ := url.Parse("http://default.example.com")
+
+	router := NewUpstreamRouter(
+		[]UpstreamRoute{{Name: "myorg", Prefix: "myorg/*", UpstreamURL: defaultUpstream}},
+		UpstreamRoute{UpstreamURL: defaultUpstream},
+		testLogger(),
+	)
+
+	route := router.Match(registryPath{Namespace: "library", Name: "ubuntu", Kind: "blobs"})
+	assert.Equal(t, "", route.Name)
+	assert.Equal(t, defaultUpstream, route.UpstreamURL)
+}
+
+func TestUpstreamRouteCacheKeyNamespacesNonDefaultRoutes(t *testing.T) {
+	defaultRoute := UpstreamRoute{}
+	namedRoute := UpstreamRoute{Name: "myorg"}
+
+	assert.Equal(t, "sha256:abc", defaultRoute.cacheKey("sha256:abc"))
+	assert.Equal(t, "myorg/sha256:abc", namedRoute.cacheKey("sha256:abc"))
+}
+
+func TestUpstreamRouteCacheForPrefersItsOwnDedicatedCache(t *testing.T) {
+	defaultCache := &testObjectStorageCache{defaultPresignedUrl: "http://localtest.me/default"}
+	dedicatedCache := &testObjectStorageCache{defaultPresignedUrl: "http://localtest.me/dedicated"}
+
+	assert.Equal(t, defaultCache, UpstreamRoute{}.cacheFor(defaultCache))
+	assert.Equal(t, dedicatedCache, UpstreamRoute{Cache: dedicatedCache}.cacheFor(defaultCache))
+}